@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// backupReader reads the entries of a backup file.
+//
+// Every backup is a complete gzip member holding a complete tar archive, so
+// backups (or parts of one built in parallel) can be concatenated with cat and
+// still be read in a single pass: gzip handles multiple members natively, and
+// backupReader continues past the tar end-of-archive marker between parts, the
+// same as 'tar --ignore-zeros'.  The shards of a backup built with --shards
+// are read one after another, the same as if they'd been concatenated.
+// Encrypted backups are decrypted on the way in, asking for the password only
+// when one is found, and backups encrypted with gpg are piped through it.
+type backupReader struct {
+	tr           *tar.Reader
+	buffered     *bufio.Reader
+	file         *os.File
+	decompressor *gzip.Reader
+	gpg          *gpgReader
+	// rest are the shards still to be read after the current one
+	rest []string
+}
+
+// openBackup opens the backup at path for reading its entries.  If there's no
+// file at path but there are shards of it, path.0 to path.N-1, they're read
+// in order.
+func openBackup(path string) (*backupReader, error) {
+	paths, err := backupFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &backupReader{rest: paths[1:]}
+	err = r.openFile(paths[0])
+	if err != nil && len(paths) > 1 {
+		return nil, fmt.Errorf("shard '%s': %s", paths[0], err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// backupFiles lists the files the backup at path is read from: path itself,
+// or its shards if only they exist.  Every shard the metadata files mention
+// has to be there.
+func backupFiles(path string) ([]string, error) {
+	if _, err := os.Stat(path); err == nil || !os.IsNotExist(err) {
+		return []string{path}, nil
+	}
+	var shards []string
+	for k := 0; ; k++ {
+		shard := fmt.Sprintf("%s.%d", path, k)
+		if _, err := os.Stat(shard); err != nil {
+			break
+		}
+		shards = append(shards, shard)
+	}
+	if len(shards) == 0 {
+		// report the missing file
+		return []string{path}, nil
+	}
+	for _, shard := range shards {
+		meta, err := readMetaFile(shard + metaSuffix)
+		if err == nil && meta.Shard != nil && meta.Shard.Count > len(shards) {
+			return nil, fmt.Errorf("only %d of its %d shards were found", len(shards), meta.Shard.Count)
+		}
+	}
+	return shards, nil
+}
+
+// openFile starts reading the backup file at path, which is either the
+// whole backup or its next shard
+func (r *backupReader) openFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	raw := bufio.NewReader(file)
+	var source io.Reader = raw
+	var gpg *gpgReader
+	switch {
+	case isEncrypted(raw):
+		source = newDecryptingReader(raw, passwords.get)
+	case isGPGMessage(raw):
+		gpg, err = newGPGReader(raw)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		source = gpg
+	}
+	decompressor, err := gzip.NewReader(source)
+	if err != nil {
+		if gpg != nil {
+			gpg.Close()
+		}
+		file.Close()
+		return err
+	}
+	r.buffered = bufio.NewReader(decompressor)
+	r.tr = tar.NewReader(r.buffered)
+	r.file = file
+	r.decompressor = decompressor
+	r.gpg = gpg
+	return nil
+}
+
+// Next advances to the next entry, skipping over the boundaries between
+// concatenated parts and shards
+func (r *backupReader) Next() (*tar.Header, error) {
+	for {
+		header, err := r.tr.Next()
+		if err != io.EOF {
+			return header, err
+		}
+		// an end-of-archive marker only ends the file if there's no more data
+		if _, err = r.buffered.Peek(1); err == nil {
+			r.tr = tar.NewReader(r.buffered)
+			continue
+		} else if err != io.EOF {
+			return nil, err
+		}
+		if len(r.rest) == 0 {
+			return nil, io.EOF
+		}
+		r.closeFile()
+		err = r.openFile(r.rest[0])
+		if err != nil {
+			return nil, fmt.Errorf("shard '%s': %s", r.rest[0], err.Error())
+		}
+		r.rest = r.rest[1:]
+	}
+}
+
+// Read reads from the current entry
+func (r *backupReader) Read(data []byte) (int, error) {
+	return r.tr.Read(data)
+}
+
+func (r *backupReader) Close() error {
+	return r.closeFile()
+}
+
+// closeFile closes the file being read
+func (r *backupReader) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	r.decompressor.Close()
+	if r.gpg != nil {
+		r.gpg.Close()
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// eachEntry calls fn with every header in the backup, stopping at the first
+// error.  fn may read the entry's contents from the reader.
+func (r *backupReader) eachEntry(fn func(header *tar.Header) error) error {
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		err = fn(header)
+		if err != nil {
+			return err
+		}
+	}
+}
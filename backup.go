@@ -3,25 +3,33 @@ package main
 import (
 	"archive/tar"
 	"bufio"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"crypto/ecdh"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
 
 	"compress/gzip"
 
-	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	usage = `Usage:
-	backup [--help] <build|restore> [--help] [OPTIONS]`
+	backup [--help] <build|restore|find|diff-manifests|prune|lock|unlock|report|check|status|tartest|init-list|keygen|export|sign|verify-sig> [--help] [OPTIONS]`
 
 	help = usage + `
 
@@ -32,7 +40,22 @@ To see more about each command, use 'backup <command> --help'.
 
 Commands:
 	backup     builds a backup
-	restore    restores from a backup file`
+	restore    restores from a backup file
+	find       finds files in one or more backup files
+	diff-manifests
+	           compares the manifests of two backups
+	prune      deletes old backups to stay under a size budget
+	lock       protects backups from being pruned
+	unlock     removes the protection added by lock
+	report     writes an HTML report about a backup
+	check      reports problems with list files
+	status     shows the progress of a running build
+	tartest    checks that the system tar can read a backup file
+	init-list  writes a starter list file for your home directory
+	keygen     makes a key pair for encrypting backups to a public key
+	export     writes a mirror snapshot as a standalone tarball
+	sign       writes a detached signature for a backup
+	verify-sig checks a backup against its signature`
 )
 
 type exitError struct {
@@ -75,6 +98,34 @@ func program() int {
 		err = build(os.Args[2:])
 	case "restore":
 		err = restore(os.Args[2:])
+	case "prune":
+		err = prune(os.Args[2:])
+	case "diff-manifests":
+		err = diffManifests(os.Args[2:])
+	case "lock":
+		err = lock(os.Args[2:], false)
+	case "unlock":
+		err = lock(os.Args[2:], true)
+	case "report":
+		err = report(os.Args[2:])
+	case "find":
+		err = find(os.Args[2:])
+	case "status":
+		err = status(os.Args[2:])
+	case "check":
+		err = check(os.Args[2:])
+	case "tartest":
+		err = tarTest(os.Args[2:])
+	case "init-list":
+		err = initList(os.Args[2:])
+	case "keygen":
+		err = keygen(os.Args[2:])
+	case "export":
+		err = export(os.Args[2:])
+	case "sign":
+		err = sign(os.Args[2:])
+	case "verify-sig":
+		err = verifySig(os.Args[2:])
 	case "--help", "-h":
 		fmt.Println(help)
 		return 0
@@ -94,31 +145,171 @@ func program() int {
 }
 
 func build(args []string) error {
-	listPaths := []string{}
-	outPaths := []string{}
-	for i := 0; i < len(args); i += 2 {
+	opts := buildOptions{retries: 3, maxFiles: defaultMaxFiles}
+	for i := 0; i < len(args); i++ {
 		switch args[i] {
 		case "--help", "-h":
 			fmt.Println(`Usage:
-	backup build [--help] [-l LIST] [-o OUTPUT]
+	backup build [--help] [-l LIST] [-o OUTPUT] [--meta] [--manifest] [--compat tar]
+	             [--retries N] [--home DIR] [--shards N] [--forbid-outside]
+	             [--netfs POLICY] [--open-files POLICY] [--max-files N]
+	             [--max-size SIZE] [--max-memory SIZE] [--preflight]
+	             [--format tgz|mirror] [--require-all|--require-any]
+	             [--status-file FILE] [--rule-stats] [--disk-friendly]
+	             [--strict-metadata] [--include-own-state] [--retry-denied]
+	             [--encrypt] [--password-file FILE] [--use-keyring]
+	             [--allow-weak-password] [--recipient KEY]... [--gpg RECIPIENT]...
 
 The build command backs up a list of files as determined by the provided lists
-and saves them in an AES encrypted tarball.The list files operate in stages,
+and saves them in a gzipped tarball.  The list files operate in stages,
 indicated by either [include] or [exclude] markers.  After each marker, backup
 looks for a newline-delimited list of glob patterns to match agains files.  You
 can add an unlimited number of stages of [include] and [exclude] that will be
 evaluated in order.  If the first marker is an include, it is assumed everything
 else is excluded by default, and if the first stage is an exclude, it is assumed
-everything in your user directory is included by default.
+everything in your user directory is included by default.  Lines starting
+with # are comments.
+
+Patterns are matched relative to your home directory, which is taken from
+--home, then $HOME, then the user database.
 
 You can set multiple list files and output paths by using their options twice,
 as in 'backup -l list1 -l list2 -o backup1 -o backup2'.  In this case, the list
 files will be loaded in the order that they're listed.
 
+A marker can take arguments.  In '[include base=/etc prefix=system/etc]', the
+rules are matched relative to /etc instead of your home directory, and what
+they match is stored under system/etc in the backup.
+
+'syntax=regex' makes a section's rules regular expressions instead of globs,
+and 'nocase' makes them ignore case, as in '[exclude syntax=regex nocase]'.
+Either kind of pattern has to match a whole path.  Regular expressions and
+case-insensitive globs in [include] sections are matched against paths
+relative to the section's base.
+
+Rules can be prefixed with modifiers that change how matching files are stored:
+	gitbundle:GLOB  git work trees under GLOB are stored as a 'git bundle --all'
+	                saved to .git.bundle in the work tree instead of their .git
+	                directory; restore history with 'git clone .git.bundle'
+	type:KINDS:GLOB only files of the comma separated KINDS are included from
+	                GLOB, going by extension and then by content; the kinds are
+	                image, audio, video, document, text, source, and archive
+
+Backups can be concatenated, as in 'cat part1 part2 > whole', and the result is
+read by backup in a single pass.  The system tar needs '--ignore-zeros' to read
+past the first part.
+
+Sending a running build SIGUSR1, as in 'kill -USR1 PID', prints how far along it
+is to standard error.
+
 Options:
 	-h, --help      this help message
-	-l, --list      file that contains what's to be excluded and included in the backup, defaults to ./backup.list
-	-o, --output    where to store the backup file, by default the output is printed to standard out`)
+	-l, --list      file that contains what's to be excluded and included in the
+	                backup, defaults to backup.list and backup.HOST.list in
+	                the first of ., $XDG_CONFIG_HOME/backup, and /etc/backup
+	                that has either, HOST being this machine's host name
+	-o, --output    where to store the backup file, by default the output is printed to standard out
+	--meta          write a <output>.meta.json file next to each output describing the backup
+	--manifest      write a <output>.manifest file next to each output listing the
+	                name, size, and modification time of every entry
+	--compat MODE   restrict the output format; 'tar' guarantees every output,
+	                and every shard, can be extracted by GNU tar and bsdtar
+	                alone: headers are written in PAX format only, and
+	                --encrypt, --recipient, and --gpg are refused, since
+	                their output needs backup or gpg to read; check a backup
+	                with 'backup tartest'
+	--retries N     how many times to retry opening a busy or locked file before
+	                skipping it, defaults to 3
+	--retry-denied  also retry files that can't be opened for lack of
+	                permission, for programs that lock files by denying
+	                access to them; otherwise those are skipped at once, since
+	                most are just unreadable
+	--home DIR      the directory to back up from instead of your home directory
+	--shards N      split the backup into N archives written in parallel, each
+	                output gets a .0 to .N-1 suffix; each shard holds part of
+	                the files, and restore, find and report read them all when
+	                given the output without the suffix; shards not encrypted
+	                with --gpg can also be concatenated into one backup
+	--forbid-outside
+	                fail instead of warning when an include rule reaches outside
+	                the home directory through a symlink or an absolute pattern
+	--netfs POLICY  what to do with network filesystems (NFS, CIFS, sshfs, and
+	                automount points) mounted inside what's being backed up:
+	                'skip' leaves them out with a warning, the default;
+	                'include' backs them up; 'fail' stops the build
+	--disk-friendly read one file at a time and pause whenever the disk is slow
+	                to respond, so a spinning disk stays usable during the
+	                backup; shards are written one after another
+	--max-files N   warn when more than N files are selected, listing the
+	                directories most of them are in; defaults to 1000000, and
+	                0 turns the warning off
+	--open-files POLICY
+	                what to do with files other processes have open for
+	                writing, such as downloads in progress: 'include' archives
+	                them without checking, the default; 'warn' archives them
+	                with a warning; 'skip' leaves them out with a warning
+	--max-size SIZE refuse to build a backup whose files take up more than SIZE
+	                on disk, counting sparse files by their allocated blocks,
+	                and stop cleanly if the output grows past SIZE, leaving a
+	                readable partial backup, or with --format mirror a partial
+	                snapshot of what was copied by then; files linked to the
+	                previous snapshot don't count; SIZE may end in K, M, G, or
+	                T
+	--max-memory SIZE
+	                keep memory use near SIZE by collecting garbage more often
+	                and writing fewer shards at once; SIZE may end in K, M, G,
+	                or T
+	--preflight     before archiving anything, check that every selected file
+	                can be read and list all the ones that can't, stopping the
+	                build if there are any
+	--format FMT    'tgz', the default, writes a gzipped tarball; 'mirror' writes
+	                a browsable directory tree into a new timestamped snapshot
+	                in the single output directory, hardlinking files that are
+	                unchanged since the previous snapshot
+	--require-all   fail if any output couldn't be written
+	--require-any   succeed if at least one output was written
+	--status-file FILE
+	                keep FILE up to date with the build's progress, for
+	                'backup status' and other monitoring
+	--rule-stats    print how many files each rule included or how many paths
+	                it excluded, to find dead or overly broad rules
+	--strict-metadata
+	                fail instead of carrying on when a file can't be stored
+	                completely: its owner has no name, it has extended
+	                attributes, or it's a socket, named pipe, or device,
+	                which are otherwise left out
+	--include-own-state
+	                back up what backup itself writes, which is otherwise left
+	                out: the outputs being written and their metadata and
+	                manifest files, the other backups prune would see and
+	                the trash in the directories they're written to, and the
+	                status file
+	--encrypt       encrypt the backup with AES-256-GCM using a key derived
+	                from a password, which is asked for on the terminal;
+	                restoring detects any change to or truncation of the backup
+	--password-file FILE
+	                read the password from the first line of FILE instead of
+	                asking for it twice
+	--use-keyring   read the password from the Secret Service keyring through
+	                secret-tool, so scheduled builds needn't keep it in a
+	                file; if it isn't there yet, it's asked for and stored
+	--allow-weak-password
+	                accept passwords shorter than 10 characters
+	--recipient KEY encrypt the backup to the public key KEY, made by 'backup
+	                keygen', instead of a password, so only the secret key can
+	                restore it; can be used more than once, and any of the
+	                keys can restore.  This isn't the age format, and age
+	                can't decrypt the backup
+	--gpg RECIPIENT pipe the backup through 'gpg --encrypt' to RECIPIENT, any
+	                user ID gpg accepts, to use existing gpg keys; can be used
+	                more than once.  Reading the backup runs 'gpg --decrypt',
+	                which asks gpg-agent for the secret key.  gpg decrypts one
+	                message at a time, so shards can't be concatenated, but
+	                are still read in turn when given the output without the
+	                shard's suffix.
+
+When some outputs are written and others fail, the build exits with status 4
+unless --require-all or --require-any is given.`)
 			return nil
 
 		case "-l", "--list":
@@ -129,7 +320,8 @@ Options:
 					code: 1,
 				}
 			}
-			listPaths = append(listPaths, s)
+			opts.listPaths = append(opts.listPaths, s)
+			i++
 		case "-o", "--output":
 			s := tryGetArg(args, i+1)
 			if s == "" {
@@ -138,175 +330,1393 @@ Options:
 					code: 1,
 				}
 			}
-			outPaths = append(outPaths, s)
+			opts.outPaths = append(opts.outPaths, s)
+			i++
+		case "--meta":
+			opts.meta = true
+		case "--manifest":
+			opts.manifest = true
+		case "--compat":
+			s := tryGetArg(args, i+1)
+			switch s {
+			case "tar":
+				opts.format = tar.FormatPAX
+			case "":
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			default:
+				return exitError{
+					msg:  fmt.Sprintf("Unknown compatibility mode '%s'", s),
+					code: 1,
+				}
+			}
+			i++
+		case "--retries":
+			n, err := strconv.Atoi(tryGetArg(args, i+1))
+			if err != nil || n < 0 {
+				return exitError{
+					msg:  fmt.Sprintf("Expected a count after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			opts.retries = n
+			i++
+		case "--retry-denied":
+			opts.retryDenied = true
+		case "--home":
+			s := tryGetArg(args, i+1)
+			if s == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			opts.home = s
+			i++
+		case "--shards":
+			n, err := strconv.Atoi(tryGetArg(args, i+1))
+			if err != nil || n < 1 {
+				return exitError{
+					msg:  fmt.Sprintf("Expected a positive count after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			opts.shards = n
+			i++
+		case "--forbid-outside":
+			opts.forbidOutside = true
+		case "--disk-friendly":
+			opts.throttle = &throttle{}
+		case "--max-files":
+			n, err := strconv.Atoi(tryGetArg(args, i+1))
+			if err != nil || n < 0 {
+				return exitError{
+					msg:  fmt.Sprintf("Expected a count after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			opts.maxFiles = n
+			i++
+		case "--open-files":
+			switch tryGetArg(args, i+1) {
+			case "include":
+				opts.openFiles = openInclude
+			case "warn":
+				opts.openFiles = openWarn
+			case "skip":
+				opts.openFiles = openSkip
+			default:
+				return exitError{
+					msg:  fmt.Sprintf("Expected 'include', 'warn', or 'skip' after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			i++
+		case "--netfs":
+			switch tryGetArg(args, i+1) {
+			case "include":
+				opts.netfs = netfsInclude
+			case "skip":
+				opts.netfs = netfsSkip
+			case "fail":
+				opts.netfs = netfsFail
+			default:
+				return exitError{
+					msg:  fmt.Sprintf("Expected 'include', 'skip', or 'fail' after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			i++
+		case "--max-size":
+			size, err := parseSize(tryGetArg(args, i+1))
+			if err != nil {
+				return exitError{
+					msg:  fmt.Sprintf("Bad size after '%s': %s", args[i], err.Error()),
+					code: 1,
+				}
+			}
+			opts.maxSize = size
+			i++
+		case "--max-memory":
+			size, err := parseSize(tryGetArg(args, i+1))
+			if err != nil || size <= 0 {
+				return exitError{
+					msg:  fmt.Sprintf("Expected a size after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			opts.maxMemory = size
+			i++
+		case "--preflight":
+			opts.preflight = true
+		case "--status-file":
+			s := tryGetArg(args, i+1)
+			if s == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			opts.statusPath = s
+			i++
+		case "--rule-stats":
+			opts.ruleStats = true
+		case "--encrypt":
+			opts.encrypt = true
+		case "--strict-metadata":
+			opts.strictMetadata = true
+		case "--include-own-state":
+			opts.includeOwnState = true
+		case "--allow-weak-password":
+			opts.allowWeakPassword = true
+		case "--gpg":
+			s := tryGetArg(args, i+1)
+			if s == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			opts.gpgRecipients = append(opts.gpgRecipients, s)
+			i++
+		case "--recipient":
+			recipient, err := parseRecipient(tryGetArg(args, i+1))
+			if err != nil {
+				return exitError{
+					msg:  fmt.Sprintf("Bad public key after '%s': %s", args[i], err.Error()),
+					code: 1,
+				}
+			}
+			opts.recipients = append(opts.recipients, recipient)
+			i++
+		case "--use-keyring":
+			passwords.keyring = true
+		case "--password-file":
+			s := tryGetArg(args, i+1)
+			if s == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			passwords.file = s
+			i++
+		case "--require-all":
+			opts.require = requireAll
+		case "--require-any":
+			opts.require = requireAny
+		case "--format":
+			s := tryGetArg(args, i+1)
+			switch s {
+			case "tgz":
+				opts.mirror = false
+			case "mirror":
+				opts.mirror = true
+			case "":
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			default:
+				return exitError{
+					msg:  fmt.Sprintf("Unknown format '%s'", s),
+					code: 1,
+				}
+			}
+			i++
 		}
 	}
 
-	if len(listPaths) == 0 {
-		listPaths = append(listPaths, "backup.list") // the default list file
+	if len(opts.listPaths) == 0 {
+		opts.listPaths = defaultListPaths()
+	}
+	if (opts.meta || opts.manifest) && len(opts.outPaths) == 0 {
+		return exitError{
+			msg:  "--meta and --manifest require at least one output file",
+			code: 1,
+		}
+	}
+	if opts.mirror && (len(opts.outPaths) != 1 || opts.shards > 1 || opts.meta || opts.manifest || opts.format != tar.FormatUnknown || opts.encrypt || len(opts.recipients) > 0 || len(opts.gpgRecipients) > 0 || opts.strictMetadata) {
+		return exitError{
+			msg:  "--format mirror needs exactly one output directory and can't be used with --shards, --meta, --manifest, --compat, --encrypt, --recipient, --gpg, or --strict-metadata",
+			code: 1,
+		}
 	}
-	return runBuild(listPaths, outPaths)
+	encryptions := 0
+	for _, used := range []bool{opts.encrypt, len(opts.recipients) > 0, len(opts.gpgRecipients) > 0} {
+		if used {
+			encryptions++
+		}
+	}
+	if encryptions > 1 {
+		return exitError{
+			msg:  "A backup can be encrypted with only one of --encrypt, --recipient, and --gpg",
+			code: 1,
+		}
+	}
+	if opts.format == tar.FormatPAX && encryptions > 0 {
+		return exitError{
+			msg:  "--compat tar can't be used with --encrypt, --recipient, or --gpg",
+			code: 1,
+		}
+	}
+	if len(opts.recipients) > maxRecipients {
+		return exitError{
+			msg:  fmt.Sprintf("A backup can have at most %d recipients", maxRecipients),
+			code: 1,
+		}
+	}
+	if opts.shards > 1 && len(opts.outPaths) == 0 {
+		return exitError{
+			msg:  "--shards requires at least one output file",
+			code: 1,
+		}
+	}
+	return runBuild(opts)
 }
 
-func runBuild(listPaths []string, outPaths []string) error {
-	stages := []buildStage{}
-	for _, listPath := range listPaths {
-		file, err := os.Open(listPath)
+// requirement is how many outputs must be written for a build to succeed
+type requirement int
+
+const (
+	// requirePartial reports a partial success with its own exit status
+	requirePartial requirement = iota
+	requireAll
+	requireAny
+)
+
+// netfsPolicy is what to do with a network filesystem found during the walk
+type netfsPolicy int
+
+const (
+	// netfsSkip leaves network filesystems out with a warning
+	netfsSkip netfsPolicy = iota
+	netfsInclude
+	netfsFail
+)
+
+// openPolicy is what to do with files that are open for writing
+type openPolicy int
+
+const (
+	// openInclude archives files without checking whether they're open
+	openInclude openPolicy = iota
+	openWarn
+	openSkip
+)
+
+// buildOptions collects everything the build command was asked to do
+type buildOptions struct {
+	listPaths []string
+	outPaths  []string
+	// meta enables writing a sidecar metadata file next to each output
+	meta bool
+	// manifest enables writing a list of the entries next to each output
+	manifest bool
+	// format forces the header format of every entry, FormatUnknown lets the
+	// tar writer pick
+	format tar.Format
+	// retries is how many more times to try opening a busy file
+	retries int
+	// retryDenied retries files that can't be opened for lack of permission
+	// as well
+	retryDenied bool
+	// home overrides the directory backed up from
+	home string
+	// shards is how many archives to split the backup into
+	shards int
+	// forbidOutside makes rules that match outside the home directory fatal
+	forbidOutside bool
+	// netfs decides what happens to network filesystems mounted inside what's
+	// being backed up
+	netfs netfsPolicy
+	// openFiles decides what happens to files other processes are writing
+	openFiles openPolicy
+	// maxFiles is how many files can be selected without a warning, 0 for
+	// no limit
+	maxFiles int
+	// throttle paces reads for spinning disks, nil to read flat out
+	throttle *throttle
+	// preflight checks every file can be read before building
+	preflight bool
+	// mirror writes a directory tree instead of an archive
+	mirror bool
+	// encrypt seals every archive with a key derived from a password
+	encrypt bool
+	// allowWeakPassword accepts short passwords with a warning
+	allowWeakPassword bool
+	// recipients are the public keys to encrypt to instead of a password
+	recipients []*ecdh.PublicKey
+	// gpgRecipients are who gpg encrypts to, if it's used
+	gpgRecipients []string
+	// strictMetadata fails the build on any file whose metadata can't all
+	// be stored
+	strictMetadata bool
+	// includeOwnState backs up the outputs, earlier backups, and state
+	// files that are otherwise left out
+	includeOwnState bool
+	// ownState is what's left out, nil with includeOwnState
+	ownState *ownState
+	// key is what the archives are encrypted with, set once the build starts
+	key *archiveKey
+	// require decides whether a build that wrote only some outputs failed
+	require requirement
+	// ruleStats prints what each rule matched
+	ruleStats bool
+	// statusPath is where progress is reported during the build, if set
+	statusPath string
+	// progress tracks how far along the build is
+	progress *progress
+	// maxSize limits the total size of all outputs, 0 for no limit
+	maxSize int64
+	// maxMemory is the memory budget for the build, 0 for no limit
+	maxMemory int64
+	// written counts the bytes written to all outputs so far
+	written int64
+}
+
+// archiveMemory is roughly what writing one archive costs, mostly the
+// compressor's window and hash tables
+const archiveMemory = 4 << 20
+
+// concurrentArchives is how many of n archives can be written at once within
+// the memory budget.  Half the budget is left for everything else.
+func concurrentArchives(n int, maxMemory int64) int {
+	if maxMemory <= 0 {
+		return n
+	}
+	allowed := int(maxMemory / 2 / archiveMemory)
+	if allowed < 1 {
+		return 1
+	}
+	if allowed > n {
+		return n
+	}
+	return allowed
+}
+
+func runBuild(opts buildOptions) (err error) {
+	if opts.maxMemory > 0 {
+		debug.SetMemoryLimit(opts.maxMemory)
+	}
+	// progress can be asked for with SIGUSR1 from the start, since selecting
+	// the files is often the longest part of a build
+	opts.progress = newProgress(0, sizeEstimate{})
+	stopReports := make(chan struct{})
+	defer close(stopReports)
+	go opts.progress.reportOnSignal(stopReports)
+	opts.progress.setPhase("loading list files")
+	if opts.encrypt {
+		// ask for the password before the walk, which can take a while, and
+		// derive the key once for every shard
+		password, err := passwords.getNew(opts.allowWeakPassword)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to open list file '%s': %s\n", listPath, err.Error())
-			continue
+			return err
+		}
+		opts.key, err = newArchiveKey(password)
+		if err != nil {
+			return fmt.Errorf("Unable to derive the encryption key: %s", err.Error())
 		}
+	} else if len(opts.recipients) > 0 {
+		opts.key, err = newRecipientKey(opts.recipients)
+		if err != nil {
+			return fmt.Errorf("Unable to make the encryption key: %s", err.Error())
+		}
+	}
+	stages, loaded, problems, err := loadLists(opts.listPaths)
+	if err != nil {
+		return err
+	}
+	for _, listPath := range loaded {
+		fmt.Fprintf(os.Stderr, "Loaded list file '%s'\n", listPath)
+	}
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p.Error())
+	}
+	if hasListErrors(problems) {
+		return exitError{
+			msg:  "Unable to build a backup from list files with errors",
+			code: 1,
+		}
+	}
+
+	// each archive is written to all of its paths, or to stdout if it has none
+	archivePaths := [][]string{opts.outPaths}
+	if opts.shards > 1 {
+		archivePaths = shardPaths(opts.outPaths, opts.shards)
+	}
 
-		stages, err = loadStages(file, stages)
+	// output paths are relative to where we were invoked, not the home directory
+	if opts.statusPath != "" {
+		opts.statusPath, err = filepath.Abs(opts.statusPath)
 		if err != nil {
 			return err
 		}
-		file.Close()
 	}
-
-	var output io.Writer
-	if len(outPaths) == 0 {
-		output = os.Stdout
-	} else {
-		var opened []io.Writer
-		for _, outPath := range outPaths {
-			file, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	for _, paths := range archivePaths {
+		for i, outPath := range paths {
+			paths[i], err = filepath.Abs(outPath)
 			if err != nil {
 				return err
 			}
-			defer file.Close()
-			opened = append(opened, file)
-		}
-		if len(opened) == 1 {
-			output = opened[0]
-		} else {
-			output = io.MultiWriter(opened...)
 		}
 	}
 
-	err := goHome()
+	if !opts.includeOwnState {
+		opts.ownState = findOwnState(archivePaths, opts.statusPath, opts.mirror)
+	}
+
+	err = goHome(opts.home)
 	if err != nil {
 		return fmt.Errorf("Unable to chdir into home directory: %s", err.Error())
 	}
 
-	fileList, err := compileStages(stages)
+	opts.progress.setPhase("selecting files")
+	selected, err := compileStages(stages, &opts)
 	if err != nil {
 		return err
 	}
+	if opts.ownState != nil && opts.ownState.left > 0 {
+		fmt.Fprintf(os.Stderr, "Left out %d of backup's own outputs, earlier backups, and state files\n", opts.ownState.left)
+	}
+	for _, problem := range selected.problems {
+		fmt.Fprintln(os.Stderr, "Warning: "+problem.Error())
+	}
+	if len(selected.problems) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %d problems while selecting files, the backup may be missing files\n", len(selected.problems))
+	}
+	if opts.ruleStats {
+		printRuleStats(selected.ruleStats)
+	}
 
-	// aesStream, err := setupCryptoStream(output)
-	// if err != nil {
-	// 	return err
-	// }
-	// defer aesStream.Close()
+	opts.progress.setTotals(len(selected.files)+len(selected.gitRepos), sizeEstimate{})
+	warnFileCount(selected, opts.maxFiles)
+	warnCaseCollisions(selected)
+	opts.progress.setPhase("checking files")
+	sortForLocality(selected.files)
 
-	// archiver := tar.NewWriter(aesStream)
-	// defer archiver.Close()
+	if opts.openFiles != openInclude {
+		checkOpenFiles(&selected, opts.openFiles == openSkip)
+	}
 
-	compressor := gzip.NewWriter(output)
-	defer compressor.Close()
-	archiver := tar.NewWriter(compressor)
-	defer archiver.Close()
+	if opts.preflight {
+		unreadable := preflight(selected)
+		for _, problem := range unreadable {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		if len(unreadable) > 0 {
+			return exitError{
+				msg:  fmt.Sprintf("Preflight found %d unreadable files", len(unreadable)),
+				code: 3,
+			}
+		}
+	}
+
+	if opts.maxSize > 0 {
+		// sparse files are mostly holes that compress to nearly nothing, so
+		// they're counted by what they take up on disk
+		estimate := estimateSize(selected)
+		if estimate.allocated > opts.maxSize {
+			return exitError{
+				msg:  fmt.Sprintf("The selected files take up %d bytes, more than the --max-size of %d", estimate.allocated, opts.maxSize),
+				code: 3,
+			}
+		}
+	}
+
+	if opts.statusPath != "" {
+		opts.progress.setTotals(len(selected.files)+len(selected.gitRepos), estimateSize(selected))
+	}
+	opts.progress.setPhase("")
+	if opts.statusPath != "" {
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go opts.progress.watch(opts.statusPath, stop, done)
+		defer func() {
+			opts.progress.finish(err)
+			close(stop)
+			<-done
+		}()
+	}
+
+	if opts.mirror {
+		return writeMirror(archivePaths[0][0], selected, &opts)
+	}
+
+	outputs := make([]*fanout, len(archivePaths))
+	for k, paths := range archivePaths {
+		outputs[k] = openOutputs(paths)
+	}
 
-	for _, path := range fileList {
-		err = archiveFile(archiver, path)
+	parts := partitionSelection(selected, len(outputs))
+	results := make([]archiveResult, len(outputs))
+	concurrent := concurrentArchives(len(outputs), opts.maxMemory)
+	if opts.throttle != nil {
+		// shards read from the same disk, so one at a time
+		concurrent = 1
+	}
+	slots := make(chan struct{}, concurrent)
+	var wg sync.WaitGroup
+	for k := range outputs {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[k] = writeArchive(outputs[k], parts[k], &opts)
+		}(k)
+	}
+	wg.Wait()
+
+	// a destination only succeeded if every archive written to it did
+	failures := make([]error, len(opts.outPaths))
+	var firstErr error
+	for k, output := range outputs {
+		output.close()
+		for j, dest := range output.dests {
+			err := dest.err
+			if err == nil {
+				err = results[k].err
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if err != nil && j < len(failures) && failures[j] == nil {
+				failures[j] = err
+			}
+		}
+	}
+	if len(opts.outPaths) == 0 {
+		return firstErr
+	}
+
+	var build string
+	if opts.shards > 1 {
+		build, err = newBuildID()
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	succeeded := 0
+	for j, failure := range failures {
+		if failure != nil {
+			continue
+		}
+		succeeded++
+		for k, result := range results {
+			outPath := archivePaths[k][j]
+			if opts.manifest {
+				err = writeManifest(outPath+manifestSuffix, result.summary)
+				if err != nil {
+					return fmt.Errorf("Unable to write manifest file '%s': %s", outPath+manifestSuffix, err.Error())
+				}
+			}
+			if opts.meta {
+				var shard *metaShard
+				if build != "" {
+					shard = &metaShard{Build: build, Index: k, Count: len(results)}
+				}
+				err = writeMeta(outPath+metaSuffix, result.summary, result.written, opts.encryption(), shard)
+				if err != nil {
+					return fmt.Errorf("Unable to write metadata file '%s': %s", outPath+metaSuffix, err.Error())
+				}
+			}
+		}
+	}
+
+	if succeeded == len(failures) {
+		return nil
+	}
+	if len(failures) > 1 {
+		for j, failure := range failures {
+			if failure == nil {
+				fmt.Fprintf(os.Stderr, "Output '%s': written\n", opts.outPaths[j])
+			} else {
+				fmt.Fprintf(os.Stderr, "Output '%s': failed, %s\n", opts.outPaths[j], failure.Error())
+			}
+		}
+	}
+	switch {
+	case succeeded == 0:
+		return firstErr
+	case opts.require == requireAny:
+		return nil
+	case opts.require == requireAll:
+		return exitError{
+			msg:  fmt.Sprintf("Only %d of %d outputs were written", succeeded, len(failures)),
+			code: 2,
+		}
+	default:
+		return exitError{
+			msg:  fmt.Sprintf("Only %d of %d outputs were written", succeeded, len(failures)),
+			code: 4,
+		}
+	}
+}
+
+// archiveResult is the outcome of writing one archive
+type archiveResult struct {
+	summary *buildSummary
+	// written is the number of bytes written to the output
+	written int64
+	err     error
+}
+
+// writeArchive writes a complete backup of selected to output
+func writeArchive(output *fanout, selected selection, opts *buildOptions) archiveResult {
+	counter := &countingWriter{w: output, total: &opts.written}
+	result := archiveResult{summary: newBuildSummary(opts.manifest)}
+	var sink io.Writer = counter
+	var enc encryptor
+	switch {
+	case opts.key != nil:
+		w, err := newEncryptingWriter(counter, opts.key)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		enc = w
+	case len(opts.gpgRecipients) > 0:
+		w, err := newGPGWriter(counter, opts.gpgRecipients)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		enc = w
+	}
+	if enc != nil {
+		sink = enc
+	}
+	// an archive that isn't finished is abandoned: gpg is stopped, the last
+	// encrypted chunk is never written, and the partial files are removed
+	finished := false
+	defer func() {
+		if finished {
+			return
+		}
+		if enc != nil {
+			enc.abort()
+		}
+		output.discard()
+	}()
+	compressor := gzip.NewWriter(sink)
+	archiver := tar.NewWriter(compressor)
+
+	for _, file := range selected.files {
+		opts.progress.starting(file.path)
+		header, err := archiveFileAs(archiver, file.path, file.name, opts)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		opts.progress.done(header)
+		result.summary.add(header)
+		if result.err = opts.checkMaxSize(file.path); result.err != nil {
+			break
+		}
+	}
+	for _, repo := range selected.gitRepos {
+		if result.err != nil {
+			break
+		}
+		opts.progress.starting(repo.path)
+		header, err := archiveGitBundle(archiver, repo, opts)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		opts.progress.done(header)
+		result.summary.add(header)
+		result.err = opts.checkMaxSize(repo.path)
+	}
+
+	// close explicitly so the metadata can describe the finished archive, and
+	// so an archive stopped early is still readable
+	err := archiver.Close()
+	if err == nil {
+		err = compressor.Close()
+	}
+	if err == nil && enc != nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		result.err = err
+		return result
+	}
+	finished = true
+	result.written = counter.n
+	if result.err == nil && opts.maxSize > 0 && atomic.LoadInt64(&opts.written) > opts.maxSize {
+		// the compressor held back the last of the data until it was closed
+		result.err = exitError{
+			msg:  fmt.Sprintf("The finished backup grew past the --max-size of %d bytes", opts.maxSize),
+			code: 3,
+		}
+	}
+	return result
+}
+
+// encryptor encrypts an archive on its way to the outputs.  Close finishes
+// the encrypted stream, and abort gives up on it without finishing it.
+type encryptor interface {
+	io.WriteCloser
+	abort()
+}
+
+// encryption describes what the archives are encrypted with for the metadata
+// file
+func (opts *buildOptions) encryption() metaEncryption {
+	if opts.key != nil {
+		return opts.key.describe()
+	}
+	if len(opts.gpgRecipients) > 0 {
+		return metaEncryption{Cipher: gpgCipher, Recipients: len(opts.gpgRecipients)}
+	}
+	return metaEncryption{Cipher: "none"}
 }
 
-// loadStages operates similarly to the append function
-func loadStages(file *os.File, stages []buildStage) ([]buildStage, error) {
+// checkMaxSize returns an error if the outputs have grown past the size limit
+// after archiving path
+func (opts *buildOptions) checkMaxSize(path string) error {
+	if opts.maxSize <= 0 || atomic.LoadInt64(&opts.written) <= opts.maxSize {
+		return nil
+	}
+	return exitError{
+		msg:  fmt.Sprintf("Stopped after '%s', the backup grew past the --max-size of %d bytes", path, opts.maxSize),
+		code: 3,
+	}
+}
+
+// sortForLocality orders files so they're read in about the order they're
+// laid out on disk.  Directories stay in the order they were walked, and the
+// files in each directory are sorted by inode number, which filesystems
+// allocate close to where the data is.  Files that can't be looked at go last
+// in their directory.
+func sortForLocality(files []selectedFile) {
+	dirOrder := map[string]int{}
+	inodes := make(map[string]uint64, len(files))
+	for _, file := range files {
+		dir := path.Dir(file.path)
+		if _, ok := dirOrder[dir]; !ok {
+			dirOrder[dir] = len(dirOrder)
+		}
+		inode := uint64(math.MaxUint64)
+		if id, ok := idOf(file.path); ok {
+			inode = id.ino
+		}
+		inodes[file.path] = inode
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := dirOrder[path.Dir(files[i].path)], dirOrder[path.Dir(files[j].path)]
+		if a != b {
+			return a < b
+		}
+		return inodes[files[i].path] < inodes[files[j].path]
+	})
+}
+
+// sizeEstimate is how much the selected files add up to
+type sizeEstimate struct {
+	// apparent is the total length of the files, which is what's read
+	apparent int64
+	// allocated is how much disk the files take up, which is a better guess
+	// at the compressed size when some files are sparse
+	allocated int64
+}
+
+// estimateSize adds up the sizes of the selected files
+func estimateSize(selected selection) sizeEstimate {
+	var total sizeEstimate
+	for _, file := range selected.files {
+		apparent, allocated, ok := allocatedSize(file.path)
+		if !ok {
+			continue
+		}
+		total.apparent += apparent
+		// a file's last block is rarely full, so a dense file can be
+		// allocated a little more than its length
+		if allocated > apparent {
+			allocated = apparent
+		}
+		total.allocated += allocated
+	}
+	return total
+}
+
+// listProblem is something wrong with a list file
+type listProblem struct {
+	source string
+	// line is 0 if the problem is with the whole file
+	line    int
+	msg     string
+	warning bool
+}
+
+func (p listProblem) Error() string {
+	kind := "error"
+	if p.warning {
+		kind = "warning"
+	}
+	if p.line == 0 {
+		return fmt.Sprintf("%s: %s: %s", p.source, kind, p.msg)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", p.source, p.line, kind, p.msg)
+}
+
+// hasListErrors reports whether any of problems is more than a warning
+func hasListErrors(problems []listProblem) bool {
+	for _, p := range problems {
+		if !p.warning {
+			return true
+		}
+	}
+	return false
+}
+
+// loadLists loads the stages of each list file in order.  Files that can't be
+// opened are reported as warnings and skipped.
+func loadLists(listPaths []string) (stages []buildStage, loaded []string, problems []listProblem, err error) {
+	stages = []buildStage{}
+	for _, listPath := range listPaths {
+		file, err := os.Open(listPath)
+		if err != nil {
+			problems = append(problems, listProblem{
+				source:  listPath,
+				msg:     "Unable to open list file: " + err.Error(),
+				warning: true,
+			})
+			continue
+		}
+
+		var found []listProblem
+		stages, found, err = loadStages(file, stages)
+		file.Close()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Unable to read list file '%s': %s", listPath, err.Error())
+		}
+		problems = append(problems, found...)
+		loaded = append(loaded, listPath)
+	}
+	return stages, loaded, problems, nil
+}
+
+// defaultListPaths finds the list files to use when none are given.  They're
+// looked for in the current directory, then backup/ in the user's config
+// directory, then /etc/backup, and the first of those holding backup.list or
+// backup.HOST.list is used.  The host's list is loaded after the shared one so
+// it can add to it.  If none of them exist, ./backup.list is returned so the
+// missing file is reported.
+func defaultListPaths() []string {
+	dirs := []string{"."}
+	if config, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(config, "backup"))
+	}
+	dirs = append(dirs, "/etc/backup")
+
+	var hostNames []string
+	if host, err := os.Hostname(); err == nil && host != "" {
+		hostNames = append(hostNames, "backup."+host+".list")
+		if short, _, found := strings.Cut(host, "."); found {
+			hostNames = append(hostNames, "backup."+short+".list")
+		}
+	}
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	for _, dir := range dirs {
+		var found []string
+		if shared := filepath.Join(dir, "backup.list"); exists(shared) {
+			found = append(found, shared)
+		}
+		for _, name := range hostNames {
+			if host := filepath.Join(dir, name); exists(host) {
+				found = append(found, host)
+				break
+			}
+		}
+		if len(found) > 0 {
+			return found
+		}
+	}
+	return []string{"backup.list"}
+}
+
+// loadStages operates similarly to the append function.  Problems found in the
+// file are returned rather than stopping the load, so they can all be reported
+// at once.
+func loadStages(file *os.File, stages []buildStage) ([]buildStage, []listProblem, error) {
+	var problems []listProblem
+	problem := func(line int, warning bool, format string, args ...interface{}) {
+		problems = append(problems, listProblem{
+			source:  file.Name(),
+			line:    line,
+			msg:     fmt.Sprintf(format, args...),
+			warning: warning,
+		})
+	}
+
 	var stage *buildStage
+	// seen maps the rules of the current stage to the line they're first on
+	var seen map[buildRule]int
+	strayReported := false
 	scanner := bufio.NewScanner(file)
 	for i := 1; scanner.Scan(); i++ {
 		line := strings.TrimSpace(scanner.Text())
-		switch line {
-		case "[include]":
-			stages = append(stages, buildStage{
-				include: true,
-				source:  file.Name(),
-			})
-			stage = &stages[len(stages)-1]
-		case "[exclude]":
-			stages = append(stages, buildStage{
-				include: false,
-				source:  file.Name(),
-			})
+		switch {
+		case line == "": // don't add empty lines
+		case strings.HasPrefix(line, "#"): // or comments
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			header, msg := parseStageHeader(line)
+			if msg != "" {
+				problem(i, false, "%s", msg)
+				// don't add the rules that follow to the previous stage
+				stage = nil
+				strayReported = true
+				continue
+			}
+			header.source = file.Name()
+			stages = append(stages, header)
 			stage = &stages[len(stages)-1]
-		case "": // don't add empty lines
+			seen = map[buildRule]int{}
 		default:
 			if stage == nil {
 				// if we haven't reached an [include] or [exclude] header
+				if !strayReported {
+					problem(i, true, "'%s' is not in an [include] or [exclude] section and is ignored", line)
+					strayReported = true
+				}
 				continue
 			}
 
-			stage.rules = append(stage.rules, buildRule{glob: line, line: i})
+			rule, warning := parseRule(line, i)
+			if warning != "" {
+				problem(i, true, "%s", warning)
+			}
+			rule.regex = stage.regex
+			rule.nocase = stage.nocase
+			if rule.glob == "" {
+				problem(i, false, "rule '%s' has no pattern", line)
+				continue
+			}
+			if _, err := compilePattern(rule); err != nil {
+				problem(i, false, "bad pattern '%s': %s", rule.glob, err.Error())
+				continue
+			}
+			if rule.gitBundle && !stage.include {
+				problem(i, false, "the gitbundle: modifier can only be used in [include] sections")
+				continue
+			}
+			if rule.types != "" && !stage.include {
+				problem(i, false, "the type: modifier can only be used in [include] sections")
+				continue
+			}
+			if unknown := checkFileTypes(rule.types); rule.types != "" && unknown != "" {
+				problem(i, false, "unknown type '%s' in type: modifier", unknown)
+				continue
+			}
+
+			key := rule
+			key.line = 0
+			if first, ok := seen[key]; ok {
+				problem(i, true, "duplicate rule '%s', already on line %d", line, first)
+				continue
+			}
+			seen[key] = i
+
+			stage.rules = append(stage.rules, rule)
+		}
+	}
+	return stages, problems, scanner.Err()
+}
+
+// parseStageHeader parses a section header such as [include] or
+// [include base=/etc prefix=system/etc syntax=regex nocase].  If the header is bad, the returned
+// string describes why.
+func parseStageHeader(line string) (buildStage, string) {
+	var stage buildStage
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(line, "["), "]"))
+	if len(fields) == 0 {
+		return stage, fmt.Sprintf("unknown section header '%s', expected [include] or [exclude]", line)
+	}
+	switch fields[0] {
+	case "include":
+		stage.include = true
+	case "exclude":
+		stage.include = false
+	default:
+		return stage, fmt.Sprintf("unknown section header '%s', expected [include] or [exclude]", line)
+	}
+
+	for _, arg := range fields[1:] {
+		key, value, _ := strings.Cut(arg, "=")
+		switch key {
+		case "base":
+			if value == "" {
+				return stage, "base= needs a directory"
+			}
+			stage.base = value
+		case "syntax":
+			switch value {
+			case "glob":
+				stage.regex = false
+			case "regex":
+				stage.regex = true
+			default:
+				return stage, fmt.Sprintf("unknown syntax '%s', expected glob or regex", value)
+			}
+		case "nocase":
+			if value != "" {
+				return stage, "nocase doesn't take a value"
+			}
+			stage.nocase = true
+		case "prefix":
+			value = path.Clean(value)
+			if path.IsAbs(value) || value == ".." || strings.HasPrefix(value, "../") {
+				return stage, fmt.Sprintf("prefix '%s' must be a relative path inside the backup", value)
+			}
+			stage.prefix = value
+		default:
+			return stage, fmt.Sprintf("unknown section argument '%s'", arg)
+		}
+	}
+	if !stage.include && (stage.base != "" || stage.prefix != "") {
+		return stage, "base= and prefix= can only be used in [include] sections"
+	}
+	return stage, ""
+}
+
+// parseRule splits any modifiers off the front of a rule's glob.  If
+// something looks like a modifier but isn't one, a warning is also returned.
+func parseRule(line string, lineNum int) (buildRule, string) {
+	rule := buildRule{line: lineNum}
+	for {
+		prefix, rest, found := strings.Cut(line, ":")
+		if !found {
+			break
+		}
+		switch prefix {
+		case "gitbundle":
+			rule.gitBundle = true
+		case "type":
+			// the kinds of file are the next part, as in type:image,video:GLOB
+			rule.types, rest, _ = strings.Cut(rest, ":")
+		default:
+			// not a modifier, so the colon is part of the glob
+			rule.glob = line
+			if looksLikeModifier(prefix) {
+				return rule, fmt.Sprintf("unknown modifier '%s:', treating it as part of the pattern", prefix)
+			}
+			return rule, ""
+		}
+		line = rest
+	}
+	rule.glob = line
+	return rule, ""
+}
+
+// looksLikeModifier reports whether s is shaped like a rule modifier: a
+// single lowercase word
+func looksLikeModifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < 'a' || c > 'z' {
+			return false
 		}
 	}
-	return stages, nil
+	return true
+}
+
+// selectedFile is a file chosen for the backup
+type selectedFile struct {
+	// path is where the file is read from
+	path string
+	// name is what the file is called in the backup
+	name string
+}
+
+// selection is the result of compiling the stages of a backup
+type selection struct {
+	files []selectedFile
+	// gitRepos are work trees to be stored as a git bundle, their .git
+	// directories aren't in files
+	gitRepos []selectedFile
+	// problems are errors that made the selection smaller than the rules ask
+	// for, such as unreadable directories
+	problems []error
+	// ruleStats counts what each rule matched, in the order they're listed
+	ruleStats []ruleStat
+}
+
+// ruleStat counts the files an include rule added, or the paths an exclude
+// rule removed
+type ruleStat struct {
+	source  string
+	rule    buildRule
+	include bool
+	hits    int
+	// re matches the rule if it isn't a plain glob
+	re *regexp.Regexp
 }
 
 // compileStages used the rules set out in stages to build a list of files to
-// back up
-func compileStages(stages []buildStage) ([]string, error) {
+// back up.  It must be run from the directory being backed up.
+func compileStages(stages []buildStage, opts *buildOptions) (selection, error) {
+	var selected selection
 	if len(stages) == 0 {
-		return nil, nil
+		return selected, nil
+	}
+
+	home, err := os.Getwd()
+	if err != nil {
+		return selected, err
+	}
+	home, err = filepath.EvalSymlinks(home)
+	if err != nil {
+		return selected, err
+	}
+
+	var mounts mountTable
+	if opts.netfs != netfsInclude {
+		mounts, err = readMounts()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: unable to read the mount table, network filesystems won't be detected: %s\n", err.Error())
+		}
+	}
+	// a walk error that has to stop the whole build
+	var fatal error
+	// absolute returns wpath, which is relative to the home directory, as an
+	// absolute path
+	absolute := func(wpath string) string {
+		if filepath.IsAbs(wpath) {
+			return wpath
+		}
+		return filepath.Join(home, wpath)
+	}
+	// networkMount returns the filesystem type of wpath if it's a network
+	// mount that shouldn't be walked into, which is never a stage's base
+	networkMount := func(wpath, allowed string) (string, bool) {
+		real := absolute(wpath)
+		fstype, ok := mounts.networkMount(real)
+		return fstype, ok && real != allowed
+	}
+
+	// every rule gets a hit count, in the order they're listed
+	for _, stage := range stages {
+		for _, rule := range stage.rules {
+			// the lists were checked when they were loaded
+			re, _ := compilePattern(rule)
+			selected.ruleStats = append(selected.ruleStats, ruleStat{
+				source:  stage.source,
+				rule:    rule,
+				include: stage.include,
+				re:      re,
+			})
+		}
 	}
 
 	// first, build a list of all the exclusion rules, in order
-	exclusions := []string{}
+	exclusions := []*ruleStat{}
+	next := 0
 	for _, stage := range stages {
-		if !stage.include { // !include = exclude
-			for _, rule := range stage.rules {
-				exclusions = append(exclusions, rule.glob)
+		for range stage.rules {
+			if !stage.include { // !include = exclude
+				exclusions = append(exclusions, &selected.ruleStats[next])
 			}
+			next++
 		}
 	}
 
-	list := []string{}
+	next = 0
 	for _, stage := range stages {
-		if stage.include {
-			for _, rule := range stage.rules {
-				var glob []string
-				glob, _ = filepath.Glob(rule.glob)
-				// now check the files we've found against all future exclusions
-				for _, file := range glob {
-					filepath.Walk(file, func(wpath string, info os.FileInfo, err error) error {
-						excluded := false
-						var full, base bool
-						for _, excl := range exclusions {
-							full, _ = filepath.Match(excl, wpath)
-							base, _ = filepath.Match(excl, path.Base(wpath))
-							if full || base {
-								excluded = true
-								break
+		if !stage.include {
+			// we no longer need to check against the rules listed in this stage
+			// because they're listed before any more inclusions we encounter
+			exclusions = exclusions[len(stage.rules):]
+			next += len(stage.rules)
+			continue
+		}
+
+		// rules are relative to the stage's base, which is the home directory
+		// unless it says otherwise
+		root := "."
+		allowed := home
+		if stage.base != "" {
+			root = stage.base
+			allowed, err = filepath.EvalSymlinks(root)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %s: base '%s' of a stage is unusable: %s\n", stage.source, root, err.Error())
+				next += len(stage.rules)
+				continue
+			}
+		}
+		nameOf := func(wpath string) string {
+			if stage.prefix == "" {
+				return wpath
+			}
+			rel, err := filepath.Rel(root, wpath)
+			if err != nil {
+				return wpath
+			}
+			return path.Join(stage.prefix, rel)
+		}
+
+		for _, rule := range stage.rules {
+			stat := &selected.ruleStats[next]
+			next++
+			var glob []string
+			if stat.re != nil {
+				// regular expressions and case-insensitive globs are always
+				// relative to the stage's base
+				depthGlob := rule.glob
+				if rule.regex {
+					depthGlob = ""
+				}
+				var walkErrs []error
+				glob, walkErrs = findMatches(root, stat.re, depthGlob, func(dir string) bool {
+					_, ok := networkMount(dir, allowed)
+					return ok
+				})
+				for _, err := range walkErrs {
+					selected.problems = append(selected.problems, fmt.Errorf("%s:%d: rule '%s': %s",
+						stage.source, rule.line, rule.glob, err.Error()))
+				}
+			} else {
+				pattern := filepath.Join(root, rule.glob)
+				if filepath.IsAbs(rule.glob) {
+					pattern = rule.glob
+				}
+				glob, err = filepath.Glob(pattern)
+				if err != nil {
+					selected.problems = append(selected.problems, fmt.Errorf("%s:%d: bad pattern '%s': %s",
+						stage.source, rule.line, pattern, err.Error()))
+					continue
+				}
+			}
+			// now check the files we've found against all future exclusions
+			for _, file := range glob {
+				if outside, real := isOutside(allowed, file); outside {
+					msg := fmt.Sprintf("%s:%d: rule '%s' matches '%s', which is outside %s at '%s'",
+						stage.source, rule.line, rule.glob, file, allowed, real)
+					if opts.forbidOutside {
+						return selected, exitError{msg: msg, code: 1}
+					}
+					fmt.Fprintln(os.Stderr, "Warning: "+msg)
+				}
+				// the time between calls is how long the walk spent reading
+				// the disk
+				walked := time.Now()
+				filepath.Walk(file, func(wpath string, info os.FileInfo, err error) error {
+					opts.throttle.observe(time.Since(walked))
+					walked = time.Now()
+					if err != nil {
+						selected.problems = append(selected.problems, fmt.Errorf("%s:%d: rule '%s': %s",
+							stage.source, rule.line, rule.glob, err.Error()))
+						return nil
+					}
+					opts.progress.starting(wpath)
+					name := nameOf(wpath)
+					excluded := false
+					for _, excl := range exclusions {
+						if excl.matches(wpath) || excl.matches(name) || excl.matches(path.Base(wpath)) {
+							excluded = true
+							excl.hits++
+							break
+						}
+					}
+					if !excluded && opts.ownState.contains(absolute(wpath)) {
+						if info.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+					if skipFileType(info) {
+						if opts.strictMetadata && !excluded && info.Mode()&os.ModeTemporary == 0 {
+							fatal = fmt.Errorf("'%s' is a %s, which backups don't store", wpath, specialType(info))
+							return fatal
+						}
+						return nil
+					} else if info.IsDir() {
+						if excluded {
+							// don't recurse into excluded directories
+							return filepath.SkipDir
+						}
+						if fstype, ok := networkMount(wpath, allowed); ok {
+							msg := fmt.Sprintf("%s:%d: rule '%s' reaches '%s', a network filesystem (%s)",
+								stage.source, rule.line, rule.glob, wpath, fstype)
+							if opts.netfs == netfsFail {
+								fatal = exitError{msg: msg, code: 1}
+								return fatal
 							}
+							fmt.Fprintln(os.Stderr, "Warning: "+msg+", skipping it")
+							return filepath.SkipDir
+						}
+						if rule.gitBundle && path.Base(wpath) == ".git" {
+							selected.gitRepos = append(selected.gitRepos, selectedFile{
+								path: path.Dir(wpath),
+								name: path.Dir(name),
+							})
+							stat.hits++
+							return filepath.SkipDir
 						}
-						if skipFileType(info) {
+					} else if !excluded {
+						if rule.types != "" && (!info.Mode().IsRegular() || !matchesFileType(wpath, rule.types)) {
 							return nil
-						} else if info.IsDir() {
-							if excluded {
-								// don't recurse into excluded directories
-								return filepath.SkipDir
-							}
-						} else if !excluded {
-							list = append(list, wpath)
 						}
-						return nil
-					})
+						selected.files = append(selected.files, selectedFile{path: wpath, name: name})
+						stat.hits++
+					}
+					return nil
+				})
+				if fatal != nil {
+					return selected, fatal
 				}
 			}
-		} else {
-			// we no longer need to check against the rules listed in this stage
-			// because they're listed before any more inclusions we encounter
-			exclusions = exclusions[len(stage.rules):]
 		}
 	}
 
-	return list, nil
+	return selected, nil
+}
+
+// printRuleStats prints how much each rule matched, flagging rules that
+// matched nothing
+func printRuleStats(stats []ruleStat) {
+	out := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	defer out.Flush()
+	for _, stat := range stats {
+		kind, unit := "exclude", "paths"
+		if stat.include {
+			kind, unit = "include", "files"
+		}
+		note := ""
+		if stat.hits == 0 {
+			note = "\tunused"
+		}
+		fmt.Fprintf(out, "%s:%d\t%s\t%s\t%d %s%s\n", stat.source, stat.rule.line, kind, stat.rule.glob, stat.hits, unit, note)
+	}
+}
+
+// isOutside reports whether path, once its parent directories' symlinks are
+// resolved, is outside base.  The resolved path is also returned.  The last
+// element isn't resolved since the walk doesn't follow symlinks.
+func isOutside(base string, path string) (bool, string) {
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return false, path
+	}
+	real, err := filepath.Abs(filepath.Join(parent, filepath.Base(path)))
+	if err != nil {
+		return false, path
+	}
+	rel, err := filepath.Rel(base, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return true, real
+	}
+	return false, real
 }
 
 // skipFileType checks to see if a file can be skipped based on its type stored
@@ -327,104 +1737,116 @@ func skipFileType(info os.FileInfo) bool {
 	return true
 }
 
-type ioCombo struct {
-	r io.Reader
-	w io.Writer
-}
-
-func (io ioCombo) Read(data []byte) (int, error) {
-	return io.r.Read(data)
-}
-
-func (io ioCombo) Write(data []byte) (int, error) {
-	return io.w.Write(data)
-}
-
-type managedWriter struct {
-	w        io.Writer
-	password []byte
-}
-
-func (w managedWriter) Write(data []byte) (int, error) {
-	return w.w.Write(data)
-}
-
-func (w managedWriter) Close() error {
-	for i := range w.password {
-		w.password[i] = 0
+// specialType names the type of a file skipFileType skips
+func specialType(info os.FileInfo) string {
+	mode := info.Mode()
+	switch {
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "block device"
 	}
-	return nil
+	return "special file"
 }
 
-func setupCryptoStream(output io.Writer) (io.WriteCloser, error) {
-	var term *terminal.Terminal = terminal.NewTerminal(ioCombo{r: os.Stdin, w: os.Stdout}, "Password: ")
-	password, err := term.ReadPassword("Password: ")
-	if err != nil {
-		return nil, err
+// archiveFileAs writes the file at path into archiver, stored under name.  The
+// returned header is nil if the file was skipped.
+func archiveFileAs(archiver *tar.Writer, path string, name string, opts *buildOptions) (*tar.Header, error) {
+	header := buildTarHeader(path)
+	if header == nil {
+		return nil, nil
 	}
-
-	// add padding/stip end to make password 32 bytes long to enable AES-256
-	if len(password) < 32 {
-		password += string(make([]byte, 32-len(password)))
-	} else if len(password) > 32 {
-		password = password[:32]
+	if opts.strictMetadata {
+		err := checkMetadata(path, header)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	var block cipher.Block
-	block, _ = aes.NewCipher([]byte(password))
+	// only regular files have contents to read, the rest is in the header
+	var file *os.File
+	if header.Typeflag == tar.TypeReg {
+		var err error
+		started := time.Now()
+		file, err = openRetrying(path, opts)
+		opts.throttle.observe(time.Since(started))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to open '%s': %s\n", path, err.Error())
+			return nil, nil
+		}
+		defer file.Close()
+	}
 
-	var iv [aes.BlockSize]byte
-	_, err = rand.Read(iv[:])
+	header.Name = name
+	header.Format = opts.format
+	err := archiver.WriteHeader(header)
 	if err != nil {
-		return nil, err
+		return nil, nil
 	}
-
-	// first, save the IV in the first aes.BlockSize (16) bytes of the output
-	_, err = output.Write(iv[:])
+	if file == nil {
+		return header, nil
+	}
+	_, err = io.Copy(archiver, file)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Error archiving '%s': %s", path, err.Error())
 	}
-	stream := cipher.NewOFB(block, iv[:])
-	return managedWriter{
-		password: []byte(password),
-		w:        &cipher.StreamWriter{S: stream, W: output},
-	}, nil
+	return header, nil
 }
 
-func archiveFile(archiver *tar.Writer, path string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to open '%s': %s\n", path, err.Error())
-		return nil
-	}
-	defer file.Close()
+// retryDelay is how long to wait before the first retry of a busy file, it
+// doubles with each attempt
+const retryDelay = 100 * time.Millisecond
 
-	header := buildTarHeader(path)
-	if header == nil {
-		return nil
-	}
-	err = archiver.WriteHeader(header)
-	if err != nil {
-		return nil
-	}
-	if header.Typeflag == tar.TypeSymlink {
-		// don't write anything for symlinks, the target is contained in the header
-		return nil
+// openRetrying opens path, trying again up to opts.retries times with
+// backoff if the file is busy or locked
+func openRetrying(path string, opts *buildOptions) (*os.File, error) {
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		file, err := os.Open(path)
+		if err == nil || attempt >= opts.retries || !isTransientOpenError(err, opts.retryDenied) {
+			return file, err
+		}
+		time.Sleep(delay)
+		delay *= 2
 	}
-	_, err = io.Copy(archiver, file)
+}
+
+// isTransientOpenError reports whether err may go away if the open is retried,
+// as happens when a program briefly locks the file.  Permission errors only
+// count if denied is set, since they usually mean the file is unreadable.
+func isTransientOpenError(err error, denied bool) bool {
+	return errors.Is(err, unix.EBUSY) || errors.Is(err, unix.ETXTBSY) ||
+		errors.Is(err, unix.EAGAIN) || denied && errors.Is(err, os.ErrPermission)
+}
+
+// goHome chdirs into our home directory, or into override if it's set
+func goHome(override string) error {
+	home, err := homeDir(override)
 	if err != nil {
-		return fmt.Errorf("Error archiving '%s': %s", path, err.Error())
+		return err
 	}
-	return nil
+	return os.Chdir(home)
 }
 
-// goHome chdirs into our home directory
-func goHome() error {
+// homeDir finds the directory to work from.  An explicit override wins, then
+// $HOME, and only then the user database, which often doesn't reflect the
+// directory wanted inside containers and chroots.
+func homeDir(override string) (string, error) {
+	if override != "" {
+		return override, nil
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return home, nil
+	}
 	me, err := user.Current()
 	if err != nil {
-		return err
+		return "", homeError{reason: err.Error()}
 	}
-	return os.Chdir(me.HomeDir)
+	return me.HomeDir, nil
 }
 
 // stage represents a single [include/exclude] directive
@@ -433,42 +1855,86 @@ type buildStage struct {
 	include bool
 	// source is the name of the file from which this stage originates
 	source string
+	// base is the directory the rules are relative to, empty for the home
+	// directory
+	base string
+	// prefix replaces base in the names of files stored in the backup, empty
+	// to keep their names as they're found
+	prefix string
+	// regex makes the stage's rules regular expressions instead of globs
+	regex bool
+	// nocase makes the stage's rules ignore case
+	nocase bool
 	rules  []buildRule
 }
 
 type buildRule struct {
 	glob string
 	line int
+	// gitBundle stores git work trees as bundles rather than their .git
+	gitBundle bool
+	// types limits the rule to files of the comma separated kinds, if set
+	types string
+	// regex and nocase are copied from the rule's stage
+	regex  bool
+	nocase bool
 }
 
-func restore(args []string) error {
-	var backupPath string
-	for _, arg := range args {
-		switch arg {
-		case "--help", "-h":
-			fmt.Println(`Usage:
-	backup restore [--help] <backup_file> 
-
-Restores the files provided in the given backup archive.`)
-			return nil
-
-		default:
-			if backupPath != "" {
-				return exitError{
-					msg:  "Can only restore from one backup at a time",
-					code: 1,
-				}
-			}
-			backupPath = arg
-		}
+func tryGetArg(args []string, index int) string {
+	if index < 0 || index >= len(args) {
+		return ""
 	}
+	return args[index]
+}
 
-	return nil
+// parseSize parses a byte count with an optional K, M, G, or T suffix (powers
+// of 1024)
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	var shift uint
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	case "T":
+		shift = 40
+	}
+	if shift != 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size out of range")
+	}
+	return n << shift, nil
 }
 
-func tryGetArg(args []string, index int) string {
-	if index < 0 || index > len(args) {
-		return ""
+// parseDuration parses a duration like time.ParseDuration, also allowing a
+// whole number of days or weeks with a d or w suffix
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
 	}
-	return args[index]
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	default:
+		return time.ParseDuration(s)
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * unit, nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWriteArchiveRemovesAbandonedOutput(t *testing.T) {
+	tmp := t.TempDir()
+	var selected selection
+	for _, name := range []string{"plain", "tagged"} {
+		path := filepath.Join(tmp, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		selected.files = append(selected.files, selectedFile{path: path, name: name})
+	}
+	// --strict-metadata stops the build at a file with extended attributes
+	err := unix.Setxattr(filepath.Join(tmp, "tagged"), "user.test", []byte("x"), 0)
+	if err != nil {
+		t.Skipf("can't set extended attributes here: %s", err)
+	}
+
+	key, err := newArchiveKey([]byte("correct horse battery"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []buildOptions{
+		{strictMetadata: true},
+		{strictMetadata: true, key: key},
+	} {
+		outPath := filepath.Join(tmp, "backup.tgz")
+		opts.progress = newProgress(len(selected.files), sizeEstimate{})
+		output := openOutputs([]string{outPath})
+		result := writeArchive(output, selected, &opts)
+		output.close()
+		if result.err == nil {
+			t.Fatal("archived a file with extended attributes under --strict-metadata")
+		}
+		if _, err := os.Stat(outPath); !os.IsNotExist(err) {
+			t.Errorf("the abandoned output is still there (encrypted: %t)", opts.key != nil)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// check reports every problem with the given list files without building
+func check(args []string) error {
+	var listPaths []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup check [--help] [-l LIST]
+
+Loads list files the same way 'backup build' does and reports problems with
+them: unknown section headers, rules outside of any section, duplicate rules,
+bad patterns, and misused modifiers.  Exits with an error if any problem would
+stop a build.
+
+Options:
+	-h, --help      this help message
+	-l, --list      list file to check, defaults to the same list file build
+	                would use`)
+			return nil
+
+		case "-l", "--list":
+			s := tryGetArg(args, i+1)
+			if s == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			listPaths = append(listPaths, s)
+			i++
+		}
+	}
+	if len(listPaths) == 0 {
+		listPaths = defaultListPaths()
+	}
+
+	stages, _, problems, err := loadLists(listPaths)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p.Error())
+	}
+
+	rules := 0
+	for _, stage := range stages {
+		rules += len(stage.rules)
+	}
+	if hasListErrors(problems) {
+		return exitError{
+			msg:  fmt.Sprintf("Found %d problems in list files", len(problems)),
+			code: 1,
+		}
+	}
+	fmt.Printf("%d stages with %d rules, %d warnings\n", len(stages), rules, len(problems))
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// caseNames remembers names by their lowercase form, to find names that
+// differ only in case.  On a case-insensitive filesystem, like the usual ones
+// on macOS and Windows, those are the same file, and restoring the second
+// replaces the first.
+type caseNames map[string]string
+
+// collision returns the earlier name that name differs from only in case, or
+// "" if there isn't one
+func (c caseNames) collision(name string) string {
+	name = path.Clean(name)
+	key := strings.ToLower(name)
+	first, ok := c[key]
+	if !ok {
+		c[key] = name
+		return ""
+	}
+	if first == name {
+		return ""
+	}
+	return first
+}
+
+// free returns the first name of the form NAME.~N~ that collides with no
+// name seen so far, and remembers it.  Whatever is already at that name is
+// handled like any other existing file.
+func (c caseNames) free(name string) string {
+	name = path.Clean(name)
+	for n := 1; ; n++ {
+		renamed := fmt.Sprintf("%s.~%d~", name, n)
+		if _, taken := c[strings.ToLower(renamed)]; taken {
+			continue
+		}
+		c[strings.ToLower(renamed)] = renamed
+		return renamed
+	}
+}
+
+// warnCaseCollisions warns about selected names that differ only in case
+func warnCaseCollisions(selected selection) {
+	names := caseNames{}
+	var collisions []string
+	for _, files := range [][]selectedFile{selected.files, selected.gitRepos} {
+		for _, file := range files {
+			if first := names.collision(file.name); first != "" {
+				collisions = append(collisions, fmt.Sprintf("%s and %s", first, file.name))
+			}
+		}
+	}
+	if len(collisions) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %d names differ only in case, only one of each will survive a restore onto a case-insensitive filesystem\n", len(collisions))
+	for _, collision := range collisions {
+		fmt.Fprintf(os.Stderr, "\t%s\n", collision)
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// An encrypted backup is a header followed by the gzipped tarball cut into
+// chunks, each sealed with the header's cipher suite:
+//
+//	header: magic (7) | version (1) | cipher suite (1) | key derivation (1) |
+//	        key fields | nonce prefix (7)
+//	chunk:  length (4) | sealed chunk (length)
+//
+// For a password, the key fields are:
+//
+//	salt (16) | Argon2id time (4) | Argon2id memory in KiB (4) |
+//	Argon2id threads (1)
+//
+// Keys for public key recipients are described in recipient.go.
+//
+// The magic tells encrypted backups from plain ones, which start with gzip's
+// own magic.  The key is derived from the password with the salt and
+// parameters in the header, so they can be raised later without breaking old
+// backups.  A newer version of the format is refused rather than misread.
+//
+// The high bit of a chunk's length marks the last chunk of the stream.  Each
+// chunk's nonce is the nonce prefix, the chunk's number, and a byte that's 1
+// for the last chunk, and the header is authenticated along with every chunk.
+// Chunks that are changed, reordered, dropped, or cut off all fail to open,
+// and so does a stream that ends before its last chunk.
+//
+// Like plain backups, encrypted ones can be concatenated: another header may
+// follow the last chunk.
+const (
+	encryptedMagic   = "BKUPENC"
+	encryptedVersion = 1
+	saltSize         = 16
+	kdfParamsSize    = 9
+	noncePrefixSize  = 7
+	// chunkSize is how much of the tarball is sealed at a time
+	chunkSize = 64 << 10
+	// lastChunk is the flag in a chunk's length marking the end of a stream
+	lastChunk = 1 << 31
+	// maxKDFMemory and maxKDFTime bound the parameters accepted from a
+	// header, so a damaged one can't exhaust memory or hang a restore
+	maxKDFMemory = 4 << 20
+	maxKDFTime   = 100
+	// cipherName is what the metadata file records for encrypted backups
+	cipherName = "aes-256-gcm"
+	// minPasswordLength is the shortest password build accepts without
+	// --allow-weak-password, in characters
+	minPasswordLength = 10
+)
+
+// cipherSuite identifies what chunks are sealed with
+type cipherSuite byte
+
+const suiteAES256GCM cipherSuite = 1
+
+// kdfID identifies how the key is derived from the password, or unwrapped
+// for a recipient
+type kdfID byte
+
+const (
+	kdfArgon2id   kdfID = 1
+	kdfRecipients kdfID = 2
+)
+
+// kdfParams are how a key was derived, and the Argon2id costs
+type kdfParams struct {
+	id      kdfID
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// defaultKDF is the second recommendation of RFC 9106, for machines that
+// can't spare 2GiB: 64MiB and three passes
+var defaultKDF = kdfParams{id: kdfArgon2id, time: 3, memory: 64 << 10, threads: 4}
+
+// archiveKey is the key chunks are sealed with, and how to get it back
+type archiveKey struct {
+	kdf kdfParams
+	// fields follow the key derivation byte in the header
+	fields []byte
+	aead   cipher.AEAD
+}
+
+// describe returns the non-secret parameters of the key for the metadata
+// file
+func (k *archiveKey) describe() metaEncryption {
+	meta := metaEncryption{Cipher: cipherName}
+	switch k.kdf.id {
+	case kdfArgon2id:
+		meta.KDF = "argon2id"
+		meta.Time = k.kdf.time
+		meta.Memory = k.kdf.memory
+		meta.Threads = k.kdf.threads
+	case kdfRecipients:
+		meta.KDF = "x25519"
+		// the fields start with the recipient count
+		meta.Recipients = int(k.fields[0])
+	}
+	return meta
+}
+
+// newArchiveKey derives a key from password with a new random salt
+func newArchiveKey(password []byte) (*archiveKey, error) {
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return deriveKey(password, salt, defaultKDF)
+}
+
+// deriveKey derives the key for password, salt, and kdf
+func deriveKey(password []byte, salt []byte, kdf kdfParams) (*archiveKey, error) {
+	key := argon2.IDKey(password, salt, kdf.time, kdf.memory, kdf.threads, 32)
+	aead, err := newChunkCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	fields := append([]byte(nil), salt...)
+	fields = binary.BigEndian.AppendUint32(fields, kdf.time)
+	fields = binary.BigEndian.AppendUint32(fields, kdf.memory)
+	fields = append(fields, kdf.threads)
+	return &archiveKey{kdf: kdf, fields: fields, aead: aead}, nil
+}
+
+// newChunkCipher returns the cipher chunks are sealed with under key
+func newChunkCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of chunk number n of a stream
+func chunkNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, n)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// encryptingWriter encrypts everything written to it into w.  It must be
+// closed to write the last chunk, without which the stream can't be read.
+type encryptingWriter struct {
+	w      io.Writer
+	key    *archiveKey
+	header []byte
+	prefix []byte
+	n      uint32
+	buf    []byte
+}
+
+// newEncryptingWriter writes the header of a new stream to w
+func newEncryptingWriter(w io.Writer, key *archiveKey) (*encryptingWriter, error) {
+	prefix := make([]byte, noncePrefixSize)
+	_, err := rand.Read(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var header []byte
+	header = append(header, encryptedMagic...)
+	header = append(header, encryptedVersion, byte(suiteAES256GCM), byte(key.kdf.id))
+	header = append(header, key.fields...)
+	header = append(header, prefix...)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{
+		w:      w,
+		key:    key,
+		header: header,
+		prefix: prefix,
+		buf:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (e *encryptingWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := copy(e.buf[len(e.buf):chunkSize], data)
+		e.buf = e.buf[:len(e.buf)+n]
+		data = data[n:]
+		written += n
+		if len(e.buf) == chunkSize {
+			err := e.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close writes the last chunk, which may be empty.  It doesn't close the
+// underlying writer.
+func (e *encryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+// abort drops the buffered data without writing the last chunk, so the
+// stream reads as cut short
+func (e *encryptingWriter) abort() {
+	e.buf = e.buf[:0]
+}
+
+// seal writes out the buffered data as a chunk
+func (e *encryptingWriter) seal(last bool) error {
+	if e.n == ^uint32(0) {
+		return errors.New("the backup is too large for one encrypted stream")
+	}
+	sealed := e.key.aead.Seal(nil, chunkNonce(e.prefix, e.n, last), e.buf, e.header)
+	length := uint32(len(sealed))
+	if last {
+		length |= lastChunk
+	}
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], length)
+	_, err := e.w.Write(prefix[:])
+	if err == nil {
+		_, err = e.w.Write(sealed)
+	}
+	e.n++
+	e.buf = e.buf[:0]
+	return err
+}
+
+// errTruncated is returned when an encrypted stream ends before its last chunk
+var errTruncated = errors.New("the encrypted backup is cut short")
+
+// errAuthentication is returned when a chunk doesn't open, meaning the
+// password is wrong or the backup was changed
+var errAuthentication = errors.New("wrong password, or the backup is damaged or was tampered with")
+
+// decryptingReader reads the plaintext of one or more concatenated encrypted
+// streams
+type decryptingReader struct {
+	r *bufio.Reader
+	// keys holds the keys found so far by the header fields they came from,
+	// since every shard of a backup shares one
+	keys     map[string]*archiveKey
+	password func() ([]byte, error)
+
+	key    *archiveKey
+	header []byte
+	prefix []byte
+	n      uint32
+	// ended is true after the last chunk of the current stream
+	ended bool
+	plain []byte
+	// err is kept once something goes wrong, since nothing after a bad
+	// chunk can be trusted
+	err error
+}
+
+// isEncrypted reports whether r starts with an encrypted stream's header
+func isEncrypted(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(encryptedMagic))
+	return err == nil && string(magic) == encryptedMagic
+}
+
+func newDecryptingReader(r *bufio.Reader, password func() ([]byte, error)) *decryptingReader {
+	return &decryptingReader{
+		r:        r,
+		keys:     map[string]*archiveKey{},
+		password: password,
+		ended:    true,
+	}
+}
+
+// streamHeader is the parsed header of an encrypted stream
+type streamHeader struct {
+	kdf kdfParams
+	// salt is set for passwords, and stanzas, the wrapped file keys, for
+	// recipients
+	salt    []byte
+	stanzas [][]byte
+	prefix  []byte
+	// raw is the header as written, which every chunk authenticates
+	raw []byte
+}
+
+// readStreamHeader reads and checks the header at the start of r
+func readStreamHeader(r io.Reader) (streamHeader, error) {
+	var h streamHeader
+	// read adds the next n bytes to the header, and returns them
+	read := func(n int) ([]byte, error) {
+		start := len(h.raw)
+		h.raw = append(h.raw, make([]byte, n)...)
+		_, err := io.ReadFull(r, h.raw[start:])
+		if err != nil {
+			return nil, errTruncated
+		}
+		return h.raw[start:], nil
+	}
+
+	magic, err := read(len(encryptedMagic) + 1)
+	if err != nil {
+		return h, err
+	}
+	if !bytes.HasPrefix(magic, []byte(encryptedMagic)) {
+		return h, errors.New("unexpected data after the end of an encrypted backup")
+	}
+	version := magic[len(encryptedMagic)]
+	switch {
+	case version > encryptedVersion:
+		return h, fmt.Errorf("the backup was encrypted by a newer version of backup (format %d, this one reads up to %d), upgrade to restore it", version, encryptedVersion)
+	case version < encryptedVersion:
+		return h, errors.New("the encrypted backup's header is damaged")
+	}
+
+	ids, err := read(2)
+	if err != nil {
+		return h, err
+	}
+	suite := cipherSuite(ids[0])
+	h.kdf.id = kdfID(ids[1])
+	if suite != suiteAES256GCM {
+		return h, fmt.Errorf("the backup was encrypted with cipher suite %d, which this version of backup doesn't support", suite)
+	}
+
+	switch h.kdf.id {
+	case kdfArgon2id:
+		fields, err := read(saltSize + kdfParamsSize)
+		if err != nil {
+			return h, err
+		}
+		h.salt = append([]byte(nil), fields[:saltSize]...)
+		params := fields[saltSize:]
+		h.kdf.time = binary.BigEndian.Uint32(params)
+		h.kdf.memory = binary.BigEndian.Uint32(params[4:])
+		h.kdf.threads = params[8]
+		if h.kdf.time < 1 || h.kdf.time > maxKDFTime || h.kdf.memory < 8*uint32(h.kdf.threads) || h.kdf.memory > maxKDFMemory || h.kdf.threads < 1 {
+			return h, errors.New("the encrypted backup's key derivation parameters are out of range")
+		}
+	case kdfRecipients:
+		count, err := read(1)
+		if err != nil {
+			return h, err
+		}
+		if count[0] == 0 {
+			return h, errors.New("the encrypted backup's header is damaged")
+		}
+		stanzas, err := read(int(count[0]) * stanzaSize)
+		if err != nil {
+			return h, err
+		}
+		for i := 0; i < len(stanzas); i += stanzaSize {
+			h.stanzas = append(h.stanzas, append([]byte(nil), stanzas[i:i+stanzaSize]...))
+		}
+	default:
+		return h, fmt.Errorf("the backup's key was derived with method %d, which this version of backup doesn't support", h.kdf.id)
+	}
+
+	h.prefix, err = read(noncePrefixSize)
+	return h, err
+}
+
+// start reads the header of the next stream
+func (d *decryptingReader) start() error {
+	h, err := readStreamHeader(d.r)
+	if err != nil {
+		return err
+	}
+
+	// streams that share a salt and parameters, or wrapped file keys,
+	// share a key
+	id := string(h.raw[:len(h.raw)-noncePrefixSize])
+	key, ok := d.keys[id]
+	if !ok && h.kdf.id == kdfRecipients {
+		fileKey, err := unwrapFileKey(h.stanzas, identities)
+		if err != nil {
+			return err
+		}
+		key = &archiveKey{kdf: h.kdf}
+		key.aead, err = newChunkCipher(fileKey)
+		if err != nil {
+			return err
+		}
+		d.keys[id] = key
+	} else if !ok {
+		password, err := d.password()
+		if err != nil {
+			return err
+		}
+		key, err = deriveKey(password, h.salt, h.kdf)
+		if err != nil {
+			return err
+		}
+		d.keys[id] = key
+	}
+	d.key = key
+	d.header = h.raw
+	d.prefix = h.prefix
+	d.n = 0
+	d.ended = false
+	return nil
+}
+
+func (d *decryptingReader) Read(data []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.ended {
+			// the end of the file, or the start of another stream
+			if _, err := d.r.Peek(1); err == io.EOF {
+				return 0, io.EOF
+			}
+			d.err = d.start()
+			if d.err != nil {
+				continue
+			}
+		}
+		d.err = d.open()
+	}
+	n := copy(data, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and opens the next chunk
+func (d *decryptingReader) open() error {
+	var prefix [4]byte
+	_, err := io.ReadFull(d.r, prefix[:])
+	if err != nil {
+		return errTruncated
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	last := length&lastChunk != 0
+	length &^= lastChunk
+	if length > chunkSize+uint32(d.key.aead.Overhead()) {
+		return errAuthentication
+	}
+	sealed := make([]byte, length)
+	_, err = io.ReadFull(d.r, sealed)
+	if err != nil {
+		return errTruncated
+	}
+	d.plain, err = d.key.aead.Open(sealed[:0], chunkNonce(d.prefix, d.n, last), sealed, d.header)
+	if err != nil {
+		return errAuthentication
+	}
+	d.n++
+	d.ended = last
+	return nil
+}
+
+// passwordSource supplies the password for encrypting or decrypting
+// backups, reading it once from a file or the keyring, or asking on the
+// terminal
+type passwordSource struct {
+	// file holds the password on its first line, if set
+	file string
+	// keyring is set to look for the password in the system keyring first
+	keyring  bool
+	password []byte
+}
+
+// passwords is where every command gets the password from
+var passwords = &passwordSource{}
+
+// get returns the password, reading or asking for it the first time
+func (p *passwordSource) get() ([]byte, error) {
+	if p.password != nil {
+		return p.password, nil
+	}
+	if p.keyring && p.file != "" {
+		return nil, exitError{
+			msg:  "Only one of --password-file and --use-keyring can be used",
+			code: 1,
+		}
+	}
+	if p.keyring {
+		password, err := keyringLookup()
+		if err == nil {
+			p.password = password
+			return p.password, nil
+		}
+		if err != errNotInKeyring {
+			return nil, err
+		}
+	}
+	if p.file != "" {
+		data, err := os.ReadFile(p.file)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the password file: %s", err.Error())
+		}
+		line, _, _ := bytes.Cut(data, []byte("\n"))
+		p.password = bytes.TrimSuffix(line, []byte("\r"))
+		return p.password, nil
+	}
+
+	password, err := askPassword("Password: ")
+	if err != nil {
+		return nil, err
+	}
+	p.password = password
+	return p.password, nil
+}
+
+// getNew returns the password to encrypt a new backup with.  A typed
+// password is asked for twice, since a typo would leave the backup impossible
+// to restore, and is stored in the keyring when that's used but was empty.
+// Empty passwords are always refused, and short ones unless allowWeak.
+func (p *passwordSource) getNew(allowWeak bool) ([]byte, error) {
+	store := false
+	if p.keyring && p.password == nil && p.file == "" {
+		password, err := keyringLookup()
+		switch {
+		case err == nil:
+			p.password = password
+		case err == errNotInKeyring:
+			store = true
+		default:
+			return nil, err
+		}
+	}
+	if p.password == nil && p.file == "" {
+		password, err := askPassword("Password: ")
+		if err != nil {
+			return nil, err
+		}
+		again, err := askPassword("Repeat password: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(password, again) {
+			return nil, exitError{
+				msg:  "The passwords don't match",
+				code: 1,
+			}
+		}
+		p.password = password
+	}
+	password, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+
+	length := utf8.RuneCount(password)
+	if length == 0 {
+		return nil, exitError{
+			msg:  "The password is empty",
+			code: 1,
+		}
+	}
+	if length < minPasswordLength {
+		if !allowWeak {
+			return nil, exitError{
+				msg:  fmt.Sprintf("The password is only %d characters, use at least %d or pass --allow-weak-password", length, minPasswordLength),
+				code: 1,
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Warning: the password is only %d characters, the backup is easy to break into\n", length)
+	}
+	if store {
+		err = keyringStore(password)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(os.Stderr, "Stored the password in the keyring")
+	}
+	return password, nil
+}
+
+// askPassword prompts for a password on the terminal.  The terminal is used
+// directly since standard in and out may be carrying a backup.
+func askPassword(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.New("no terminal to ask for the password on, use --password-file or --use-keyring")
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, prompt)
+	password, err := terminal.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	return password, err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testKDF is cheap enough to derive a key in every test
+var testKDF = kdfParams{id: kdfArgon2id, time: 1, memory: 64, threads: 1}
+
+// testKey derives a key for password with a new random salt
+func testKey(t *testing.T, password string) *archiveKey {
+	t.Helper()
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		t.Fatal(err)
+	}
+	key, err := deriveKey([]byte(password), salt, testKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// encryptStream encrypts plain as one stream
+func encryptStream(t *testing.T, key *archiveKey, plain []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := newEncryptingWriter(&out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// decryptStream reads everything in encrypted with password
+func decryptStream(encrypted []byte, password string) ([]byte, error) {
+	r := newDecryptingReader(bufio.NewReader(bytes.NewReader(encrypted)), func() ([]byte, error) {
+		return []byte(password), nil
+	})
+	return io.ReadAll(r)
+}
+
+// testPlaintext is long enough for two full chunks and a short last one
+func testPlaintext(t *testing.T) []byte {
+	t.Helper()
+	plain := make([]byte, 2*chunkSize+1000)
+	if _, err := rand.Read(plain); err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+// headerSize is the length of a password stream's header
+const headerSize = len(encryptedMagic) + 3 + saltSize + kdfParamsSize + noncePrefixSize
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	plain := testPlaintext(t)
+	encrypted := encryptStream(t, testKey(t, "correct horse"), plain)
+	got, err := decryptStream(encrypted, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("decrypted data differs from what was encrypted")
+	}
+}
+
+func TestEncryptedWrongPassword(t *testing.T) {
+	encrypted := encryptStream(t, testKey(t, "correct horse"), testPlaintext(t))
+	_, err := decryptStream(encrypted, "battery staple")
+	if !errors.Is(err, errAuthentication) {
+		t.Errorf("got %v, want %v", err, errAuthentication)
+	}
+}
+
+func TestEncryptedDetectsTampering(t *testing.T) {
+	encrypted := encryptStream(t, testKey(t, "correct horse"), testPlaintext(t))
+	tests := []struct {
+		what   string
+		offset int
+	}{
+		{"a ciphertext byte", headerSize + 100},
+		{"a byte of the last chunk", len(encrypted) - 1},
+		{"a salt byte", len(encryptedMagic) + 3},
+		{"a nonce prefix byte", headerSize - 1},
+	}
+	for _, test := range tests {
+		tampered := append([]byte(nil), encrypted...)
+		tampered[test.offset] ^= 1
+		if _, err := decryptStream(tampered, "correct horse"); err == nil {
+			t.Errorf("flipping %s went unnoticed", test.what)
+		}
+	}
+}
+
+func TestEncryptedDetectsTruncation(t *testing.T) {
+	key := testKey(t, "correct horse")
+	plain := testPlaintext(t)
+	encrypted := encryptStream(t, key, plain)
+	lastSealed := 4 + len(plain)%chunkSize + key.aead.Overhead()
+	tests := []struct {
+		what   string
+		length int
+	}{
+		{"the last chunk", len(encrypted) - lastSealed},
+		{"part of the last chunk", len(encrypted) - 10},
+		{"everything after the header", headerSize},
+		{"part of the header", headerSize - 3},
+	}
+	for _, test := range tests {
+		_, err := decryptStream(encrypted[:test.length], "correct horse")
+		if !errors.Is(err, errTruncated) {
+			t.Errorf("dropping %s: got %v, want %v", test.what, err, errTruncated)
+		}
+	}
+}
+
+func TestEncryptedConcatenatedStreams(t *testing.T) {
+	first, second := testPlaintext(t), []byte("the second part")
+	var encrypted []byte
+	encrypted = append(encrypted, encryptStream(t, testKey(t, "correct horse"), first)...)
+	encrypted = append(encrypted, encryptStream(t, testKey(t, "correct horse"), second)...)
+
+	got, err := decryptStream(encrypted, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append(append([]byte(nil), first...), second...)) {
+		t.Error("decrypted data differs from what was encrypted")
+	}
+
+	// the second stream's last chunk is still needed
+	_, err = decryptStream(encrypted[:len(encrypted)-1], "correct horse")
+	if !errors.Is(err, errTruncated) {
+		t.Errorf("got %v, want %v", err, errTruncated)
+	}
+}
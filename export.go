@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func export(args []string) error {
+	var snapshotPath, outPath string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup export [--help] [-o OUTPUT] <snapshot>
+
+Writes one snapshot made by 'backup build --format mirror' as a gzipped tarball
+that anyone can extract with tar, without access to the mirror or this tool.
+Files hardlinked between snapshots are stored in full.  The snapshot is either
+a snapshot directory or a mirror directory, meaning its latest snapshot.
+
+Options:
+	-h, --help      this help message
+	-o, --output    where to write the tarball, by default the output is printed
+	                to standard out`)
+			return nil
+
+		case "-o", "--output":
+			outPath = tryGetArg(args, i+1)
+			if outPath == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			i++
+		default:
+			if snapshotPath != "" {
+				return exitError{
+					msg:  "Can only export one snapshot at a time",
+					code: 1,
+				}
+			}
+			snapshotPath = args[i]
+		}
+	}
+	if snapshotPath == "" {
+		return exitError{
+			msg:  "Expected a snapshot to export",
+			code: 1,
+		}
+	}
+
+	snapshot, err := findSnapshot(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("Unable to open snapshot '%s': %s", snapshotPath, err.Error())
+	}
+	selected, err := selectSnapshot(snapshot)
+	if err != nil {
+		return fmt.Errorf("Unable to read snapshot '%s': %s", snapshot, err.Error())
+	}
+
+	var outPaths []string
+	if outPath != "" {
+		outPaths = []string{outPath}
+	}
+	// PAX headers and no encryption, as with 'build --compat tar'
+	opts := buildOptions{format: tar.FormatPAX}
+	opts.progress = newProgress(len(selected.files), sizeEstimate{})
+	output := openOutputs(outPaths)
+	result := writeArchive(output, selected, &opts)
+	output.close()
+	err = output.dests[0].err
+	if err == nil {
+		err = result.err
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to export snapshot '%s': %s", snapshot, err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d files from snapshot '%s'\n", len(selected.files), snapshot)
+	return nil
+}
+
+// findSnapshot resolves path to a snapshot directory.  A mirror directory
+// means its latest snapshot.
+func findSnapshot(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("not a directory")
+	}
+	latest, err := latestSnapshot(path)
+	if err != nil {
+		return "", err
+	}
+	if latest != "" {
+		return latest, nil
+	}
+	// the latest link, or a snapshot named directly
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := time.Parse(snapshotFormat, filepath.Base(real)); err != nil {
+		return "", fmt.Errorf("not a mirror or a snapshot in one")
+	}
+	return real, nil
+}
+
+// selectSnapshot selects everything in the snapshot at root, named as it was
+// in the build that made the snapshot
+func selectSnapshot(root string) (selection, error) {
+	var selected selection
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || skipFileType(info) {
+			return nil
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		selected.files = append(selected.files, selectedFile{path: path, name: name})
+		return nil
+	})
+	return selected, err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// defaultMaxFiles is how many files a selection can have before build warns
+// that it's probably picked up something it shouldn't have
+const defaultMaxFiles = 1000000
+
+// regenerable are directory names that usually hold caches or build output
+// that can be recreated rather than backed up
+var regenerable = map[string]bool{
+	"node_modules": true,
+	".cache":       true,
+	"__pycache__":  true,
+	".venv":        true,
+	"venv":         true,
+	"target":       true,
+	"build":        true,
+	"dist":         true,
+	".gradle":      true,
+	".m2":          true,
+	".npm":         true,
+	".cargo":       true,
+	".tox":         true,
+}
+
+// dirCount is how many selected files are somewhere under a directory
+type dirCount struct {
+	dir   string
+	files int
+}
+
+// warnFileCount warns if more than max files were selected, listing the
+// directories most of them are in
+func warnFileCount(selected selection, max int) {
+	total := len(selected.files)
+	if max <= 0 || total <= max {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %d files were selected, more than the --max-files of %d\n", total, max)
+	for _, heavy := range heavyDirs(selected.files) {
+		note := ""
+		if regenerable[path.Base(heavy.dir)] {
+			note = ", usually safe to exclude"
+		}
+		fmt.Fprintf(os.Stderr, "\t%s: %d files%s\n", heavy.dir, heavy.files, note)
+	}
+}
+
+// heavyDirs finds the directories holding a large share of files.  A
+// directory is left out when most of its files are in one of its heavy
+// subdirectories, so the directories listed are the ones to look at rather
+// than all their parents.  Directories of regenerable files are listed
+// instead of anything under them.
+func heavyDirs(files []selectedFile) []dirCount {
+	counts := map[string]int{}
+	for _, file := range files {
+		for dir := path.Dir(file.name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			counts[dir]++
+		}
+	}
+
+	// at least 5% of the files
+	threshold := len(files) / 20
+	var heavy []dirCount
+	for dir, n := range counts {
+		if n >= threshold {
+			heavy = append(heavy, dirCount{dir: dir, files: n})
+		}
+	}
+
+	var found []dirCount
+	for _, d := range heavy {
+		// a cache is worth naming even when everything in it is in one
+		// subdirectory, and what's inside it isn't
+		concentrated := false
+		for _, other := range heavy {
+			if strings.HasPrefix(d.dir, other.dir+"/") && regenerable[path.Base(other.dir)] {
+				concentrated = true
+				break
+			}
+			if strings.HasPrefix(other.dir, d.dir+"/") && other.files*2 >= d.files && !regenerable[path.Base(d.dir)] {
+				concentrated = true
+				break
+			}
+		}
+		if !concentrated {
+			found = append(found, d)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].files != found[j].files {
+			return found[i].files > found[j].files
+		}
+		return found[i].dir < found[j].dir
+	})
+	if len(found) > 10 {
+		found = found[:10]
+	}
+	return found
+}
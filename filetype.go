@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileTypes are the kinds of file a type: rule modifier can select, with the
+// extensions that identify them
+var fileTypes = map[string][]string{
+	"image":    {".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".tif", ".tiff", ".heic", ".svg", ".ico", ".raw", ".cr2", ".nef", ".dng"},
+	"audio":    {".mp3", ".flac", ".ogg", ".oga", ".opus", ".wav", ".m4a", ".aac", ".wma", ".mid"},
+	"video":    {".mp4", ".m4v", ".mkv", ".webm", ".avi", ".mov", ".wmv", ".mpg", ".mpeg"},
+	"document": {".pdf", ".doc", ".docx", ".odt", ".xls", ".xlsx", ".ods", ".ppt", ".pptx", ".odp", ".rtf", ".epub", ".tex"},
+	"text":     {".txt", ".md", ".rst", ".csv", ".tsv", ".log", ".json", ".yaml", ".yml", ".toml", ".ini", ".xml", ".html", ".htm"},
+	"source":   {".go", ".c", ".h", ".cc", ".cpp", ".hpp", ".rs", ".py", ".rb", ".js", ".ts", ".java", ".kt", ".cs", ".sh", ".pl", ".lua", ".hs", ".swift", ".sql"},
+	"archive":  {".zip", ".tar", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar"},
+}
+
+// sniffedTypes maps the media types detected from a file's first bytes to
+// kinds of file, for files whose extension doesn't say
+var sniffedTypes = map[string]string{
+	"image/":           "image",
+	"audio/":           "audio",
+	"video/":           "video",
+	"application/pdf":  "document",
+	"text/":            "text",
+	"application/zip":  "archive",
+	"application/x-gz": "archive",
+}
+
+// sniffLen is how much of a file is read to detect its type, all that
+// http.DetectContentType considers
+const sniffLen = 512
+
+// checkFileTypes returns the first of a comma separated list of kinds of file
+// that isn't known, or "" if they're all known
+func checkFileTypes(kinds string) string {
+	for _, kind := range strings.Split(kinds, ",") {
+		if _, ok := fileTypes[kind]; !ok {
+			return kind
+		}
+	}
+	return ""
+}
+
+// matchesFileType reports whether the regular file at path is one of a comma
+// separated list of kinds of file.  The extension is checked first, and the
+// contents are only sniffed if the extension isn't recognized.
+func matchesFileType(path string, kinds string) bool {
+	kind := fileTypeOf(path)
+	for _, want := range strings.Split(kinds, ",") {
+		if kind == want {
+			return true
+		}
+		// source code is text too
+		if want == "text" && kind == "source" {
+			return true
+		}
+	}
+	return false
+}
+
+// fileTypeOf works out which kind of file path is, "" if it's unknown
+func fileTypeOf(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != "" {
+		for kind, exts := range fileTypes {
+			for _, e := range exts {
+				if e == ext {
+					return kind
+				}
+			}
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	var head [sniffLen]byte
+	n, _ := file.Read(head[:])
+	if n == 0 {
+		return ""
+	}
+	mediaType := http.DetectContentType(head[:n])
+	for prefix, kind := range sniffedTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return kind
+		}
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// find searches the given backups for entries matching a glob pattern
+func find(args []string) error {
+	var pattern string
+	var backupPaths []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup find [--help] [--password-file FILE] [--use-keyring] [--identity FILE]
+	            <pattern> <backup_file>...
+
+Lists the entries of each backup file whose path or base name matches the glob
+pattern, along with their sizes and modification times.  Use it to find the
+last good copy of a file across several backups.
+
+Options:
+	-h, --help      this help message
+	--password-file FILE
+	                read the password of encrypted backups from the first line
+	                of FILE instead of asking for it
+	--use-keyring   read the password from the system keyring, where build
+	                --use-keyring stores it
+	--identity FILE
+	                decrypt backups encrypted with --recipient using the
+	                secret keys in FILE, made by 'backup keygen'; can be used
+	                more than once`)
+			return nil
+
+		case "--use-keyring":
+			passwords.keyring = true
+		case "--password-file":
+			s := tryGetArg(args, i+1)
+			if s == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			passwords.file = s
+			i++
+		case "--identity":
+			keys, err := readIdentities(tryGetArg(args, i+1))
+			if err != nil {
+				return exitError{
+					msg:  fmt.Sprintf("Unable to read the identity file after '%s': %s", args[i], err.Error()),
+					code: 1,
+				}
+			}
+			identities = append(identities, keys...)
+			i++
+		default:
+			if pattern == "" {
+				pattern = args[i]
+			} else {
+				backupPaths = append(backupPaths, args[i])
+			}
+		}
+	}
+	if pattern == "" || len(backupPaths) == 0 {
+		return exitError{
+			msg:  "Expected a pattern and at least one backup file",
+			code: 1,
+		}
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return exitError{
+			msg:  fmt.Sprintf("Bad pattern '%s': %s", pattern, err.Error()),
+			code: 1,
+		}
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer out.Flush()
+
+	failed := false
+	for _, backupPath := range backupPaths {
+		reader, err := openBackup(backupPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to open backup '%s': %s\n", backupPath, err.Error())
+			failed = true
+			continue
+		}
+
+		err = reader.eachEntry(func(header *tar.Header) error {
+			full, _ := filepath.Match(pattern, header.Name)
+			base, _ := filepath.Match(pattern, path.Base(header.Name))
+			if full || base {
+				fmt.Fprintf(out, "%s\t%s\t%d\t%s\n", backupPath, header.Name,
+					header.Size, header.ModTime.Format(time.RFC3339))
+			}
+			return nil
+		})
+		reader.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading backup '%s': %s\n", backupPath, err.Error())
+			failed = true
+		}
+	}
+
+	if failed {
+		return exitError{
+			msg:  "Some backups could not be searched",
+			code: 2,
+		}
+	}
+	return nil
+}
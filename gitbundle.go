@@ -0,0 +1,33 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+)
+
+// gitBundleName is the name a work tree's bundle is stored under, relative to
+// the work tree
+const gitBundleName = ".git.bundle"
+
+// archiveGitBundle stores the history of the git work tree at repo as a
+// bundle of all its refs.  The returned header is nil if the bundle couldn't
+// be made, in which case the work tree's files are still in the backup.
+func archiveGitBundle(archiver *tar.Writer, repo selectedFile, opts *buildOptions) (*tar.Header, error) {
+	tmp, err := os.CreateTemp("", "backup-*.bundle")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	cmd := exec.Command("git", "-C", repo.path, "bundle", "create", "--quiet", tmp.Name(), "--all")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to bundle git repository '%s': %s\n%s", repo.path, err.Error(), out)
+		return nil, nil
+	}
+	return archiveFileAs(archiver, tmp.Name(), path.Join(repo.name, gitBundleName), opts)
+}
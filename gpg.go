@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// gpgCipher is what the metadata file records for backups encrypted by gpg
+const gpgCipher = "gpg"
+
+// gpgWriter pipes everything written to it through 'gpg --encrypt', which
+// writes to the underlying writer.  It must be closed to finish the message.
+type gpgWriter struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+	closed bool
+	err    error
+}
+
+// newGPGWriter starts gpg encrypting to recipients, which are anything gpg
+// accepts as a user ID.  The tarball is already compressed, so gpg isn't
+// asked to compress it again.
+func newGPGWriter(w io.Writer, recipients []string) (*gpgWriter, error) {
+	args := []string{"--batch", "--quiet", "--encrypt", "--compress-algo", "none"}
+	for _, recipient := range recipients {
+		args = append(args, "--recipient", recipient)
+	}
+	g := &gpgWriter{cmd: exec.Command("gpg", args...)}
+	g.cmd.Stdout = w
+	g.cmd.Stderr = &g.stderr
+	stdin, err := g.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	g.stdin = stdin
+	err = g.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to run gpg: %s", err.Error())
+	}
+	return g, nil
+}
+
+func (g *gpgWriter) Write(data []byte) (int, error) {
+	n, err := g.stdin.Write(data)
+	if err != nil {
+		// gpg quit early, and the reason is in what it printed
+		return n, g.Close()
+	}
+	return n, nil
+}
+
+// Close waits for gpg to finish writing the message
+func (g *gpgWriter) Close() error {
+	if g.closed {
+		return g.err
+	}
+	g.closed = true
+	g.stdin.Close()
+	err := g.cmd.Wait()
+	if err != nil {
+		g.err = fmt.Errorf("gpg failed: %s", gpgMessage(err, &g.stderr))
+	}
+	return g.err
+}
+
+// abort kills gpg if it hasn't finished, leaving an unfinished message
+func (g *gpgWriter) abort() {
+	if g.closed {
+		return
+	}
+	g.closed = true
+	g.err = errors.New("gpg was stopped")
+	g.stdin.Close()
+	g.cmd.Process.Kill()
+	g.cmd.Wait()
+}
+
+// isGPGMessage reports whether r starts with an OpenPGP encrypted message,
+// either armored or starting with a packet holding an encrypted session key
+func isGPGMessage(r *bufio.Reader) bool {
+	if start, err := r.Peek(len("-----BEGIN PGP MESSAGE")); err == nil && string(start) == "-----BEGIN PGP MESSAGE" {
+		return true
+	}
+	first, err := r.Peek(1)
+	if err != nil || first[0]&0x80 == 0 {
+		return false
+	}
+	tag := first[0] & 0x3f
+	if first[0]&0x40 == 0 {
+		// an old format packet
+		tag = (first[0] >> 2) & 0x0f
+	}
+	// public key or symmetric key encrypted session key packets
+	return tag == 1 || tag == 3
+}
+
+// gpgReader reads what 'gpg --decrypt' makes of its input.  A failed
+// decryption is an error at the end of the output, not a short backup.
+type gpgReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	done   bool
+}
+
+// newGPGReader starts gpg decrypting r.  gpg asks gpg-agent for whatever
+// secret key and passphrase it needs.
+func newGPGReader(r io.Reader) (*gpgReader, error) {
+	g := &gpgReader{cmd: exec.Command("gpg", "--batch", "--quiet", "--decrypt")}
+	g.cmd.Stdin = r
+	g.cmd.Stderr = &g.stderr
+	stdout, err := g.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	g.stdout = stdout
+	err = g.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("the backup is encrypted with gpg, which couldn't be run: %s", err.Error())
+	}
+	return g, nil
+}
+
+func (g *gpgReader) Read(data []byte) (int, error) {
+	n, err := g.stdout.Read(data)
+	if err == io.EOF && !g.done {
+		g.done = true
+		if waitErr := g.cmd.Wait(); waitErr != nil {
+			return n, fmt.Errorf("gpg failed: %s", gpgMessage(waitErr, &g.stderr))
+		}
+	}
+	return n, err
+}
+
+// Close stops gpg if it hasn't finished
+func (g *gpgReader) Close() error {
+	if g.done {
+		return nil
+	}
+	g.done = true
+	g.cmd.Process.Kill()
+	g.cmd.Wait()
+	return nil
+}
+
+// gpgMessage describes why gpg failed, preferring what it printed
+func gpgMessage(err error, stderr *bytes.Buffer) string {
+	msg := strings.TrimSpace(stderr.String())
+	if msg == "" {
+		return err.Error()
+	}
+	lines := strings.Split(msg, "\n")
+	return strings.TrimPrefix(lines[len(lines)-1], "gpg: ")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// listSection is a group of paths a starter list suggests backing up
+type listSection struct {
+	comment string
+	paths   []string
+}
+
+// starterSections are what init-list looks for in the home directory
+var starterSections = []listSection{
+	{
+		comment: "documents and work",
+		paths:   []string{"Documents", "Desktop", "Projects", "projects", "src", "code", "Notes", "notes"},
+	},
+	{
+		comment: "dotfiles and settings",
+		paths: []string{".bashrc", ".bash_profile", ".profile", ".zshrc", ".gitconfig", ".vimrc",
+			".tmux.conf", ".config", ".ssh", ".gnupg", ".password-store", ".local/share/keyrings"},
+	},
+	{
+		comment: "pictures and media",
+		paths:   []string{"Pictures", "Photos", "Music", "Videos"},
+	},
+}
+
+// starterExclusions are caches and build output that can be recreated
+var starterExclusions = []string{
+	".cache",
+	"node_modules",
+	"__pycache__",
+	".venv",
+	"*.tmp",
+	"*.swp",
+	".local/share/Trash",
+	".config/*/Cache",
+	".config/*/GPUCache",
+}
+
+// initList writes a starter list file for the home directory
+func initList(args []string) error {
+	outPath := "backup.list"
+	var home string
+	force := false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup init-list [--help] [-o FILE] [--home DIR] [--force]
+
+Looks through your home directory and writes a starter list file with
+commented sections for documents, dotfiles, and pictures, followed by
+exclusions for common caches.  Paths that exist are included, and common ones
+that don't are left commented out.  Anything else at the top of your home
+directory is listed, commented out, so you can decide about it.  Check the
+result with 'backup check' and edit it to taste.
+
+Options:
+	-h, --help      this help message
+	-o, --output    where to write the list, defaults to ./backup.list; '-'
+	                prints it to standard out
+	--home DIR      the directory to look through instead of your home
+	                directory
+	--force         overwrite the list file if it already exists`)
+			return nil
+
+		case "-o", "--output", "--home":
+			s := tryGetArg(args, i+1)
+			if s == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			if args[i] == "--home" {
+				home = s
+			} else {
+				outPath = s
+			}
+			i++
+		case "--force":
+			force = true
+		}
+	}
+
+	home, err := homeDir(home)
+	if err != nil {
+		return err
+	}
+	list, err := starterList(home)
+	if err != nil {
+		return fmt.Errorf("Unable to look through '%s': %s", home, err.Error())
+	}
+
+	if outPath == "-" {
+		fmt.Print(list)
+		return nil
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(outPath, flags, 0666)
+	if os.IsExist(err) {
+		return exitError{
+			msg:  fmt.Sprintf("'%s' already exists, use --force to overwrite it", outPath),
+			code: 1,
+		}
+	} else if err != nil {
+		return err
+	}
+	_, err = file.WriteString(list)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote a starter list to '%s'\n", outPath)
+	return nil
+}
+
+// starterList builds the text of a starter list for home
+func starterList(home string) (string, error) {
+	entries, err := os.ReadDir(home)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString("# Generated by 'backup init-list'.  Lines starting with # are comments;\n")
+	b.WriteString("# remove the # in front of a path to back it up.\n")
+
+	covered := map[string]bool{}
+	for _, section := range starterSections {
+		fmt.Fprintf(&b, "\n# %s\n[include]\n", section.comment)
+		for _, p := range section.paths {
+			covered[strings.SplitN(p, "/", 2)[0]] = true
+			if _, err := os.Lstat(filepath.Join(home, p)); err == nil {
+				fmt.Fprintf(&b, "%s\n", p)
+			} else {
+				fmt.Fprintf(&b, "#%s\n", p)
+			}
+		}
+	}
+
+	for _, p := range starterExclusions {
+		covered[strings.SplitN(p, "/", 2)[0]] = true
+	}
+	var others []string
+	for _, entry := range entries {
+		if !covered[entry.Name()] {
+			others = append(others, entry.Name())
+		}
+	}
+	sort.Strings(others)
+	if len(others) > 0 {
+		b.WriteString("\n# everything else in your home directory\n[include]\n")
+		for _, name := range others {
+			fmt.Fprintf(&b, "#%s\n", name)
+		}
+	}
+
+	// exclusions only apply to the sections before them, so they go last
+	b.WriteString("\n# caches and build output that can be recreated\n[exclude]\n")
+	for _, p := range starterExclusions {
+		fmt.Fprintf(&b, "%s\n", p)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The password can be kept in the system keyring, so scheduled builds can
+// encrypt without it sitting in a file.  The keyring is the Secret Service,
+// reached through secret-tool from libsecret.
+const (
+	keyringService = "backup"
+	keyringAccount = "password"
+	keyringLabel   = "backup encryption password"
+)
+
+// errNotInKeyring is returned by keyringLookup when the keyring works but
+// holds no password for backup
+var errNotInKeyring = errors.New("no password in the keyring")
+
+// keyringLookup reads the password from the keyring
+func keyringLookup() ([]byte, error) {
+	cmd := exec.Command("secret-tool", "lookup", "service", keyringService, "account", keyringAccount)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if _, ok := err.(*exec.ExitError); ok && stderr.Len() == 0 {
+		// secret-tool fails quietly when there's nothing stored
+		return nil, errNotInKeyring
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the password from the keyring: %s", keyringMessage(err, &stderr))
+	}
+	return out, nil
+}
+
+// keyringStore saves password in the keyring, replacing any already there.
+// The password is given to secret-tool on its standard in, never as an
+// argument, which other users could see.
+func keyringStore(password []byte) error {
+	cmd := exec.Command("secret-tool", "store", "--label", keyringLabel, "service", keyringService, "account", keyringAccount)
+	cmd.Stdin = bytes.NewReader(password)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Unable to store the password in the keyring: %s", keyringMessage(err, &stderr))
+	}
+	return nil
+}
+
+// keyringMessage describes why secret-tool failed, preferring what it printed
+func keyringMessage(err error, stderr *bytes.Buffer) string {
+	if errors.Is(err, exec.ErrNotFound) {
+		return "secret-tool wasn't found, it's usually in the libsecret-tools or libsecret package"
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return msg
+	}
+	return err.Error()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// lock marks backups as protected from pruning, or unmarks them if unlock is
+// set.  The lock is kept in each backup's metadata file.
+func lock(args []string, unlock bool) error {
+	command := "lock"
+	if unlock {
+		command = "unlock"
+	}
+
+	var reason string
+	var backupPaths []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--help", "-h":
+			if unlock {
+				fmt.Println(`Usage:
+	backup unlock [--help] <backup_file>...
+
+Removes the lock from backups so 'backup prune' may delete them again.  As
+with lock, a backup built with --shards is given without the .N suffixes.`)
+			} else {
+				fmt.Println(`Usage:
+	backup lock [--help] [--reason TEXT] <backup_file>...
+
+Locks backups so 'backup prune' never deletes them, for instance to keep the
+last backup made before reinstalling.  Only backups built with '--meta' can
+be locked, since the lock is kept in their metadata files.  A backup built
+with --shards is locked as a whole by giving the output without the .N
+suffixes.
+
+Options:
+	-h, --help      this help message
+	--reason        a note saying why the backup is locked`)
+			}
+			return nil
+
+		case "--reason":
+			if unlock {
+				return exitError{
+					msg:  fmt.Sprintf("'%s' can only be used with lock", args[i]),
+					code: 1,
+				}
+			}
+			reason = tryGetArg(args, i+1)
+			if reason == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			i++
+		default:
+			backupPaths = append(backupPaths, args[i])
+		}
+	}
+	if len(backupPaths) == 0 {
+		return exitError{
+			msg:  fmt.Sprintf("Expected at least one backup file to %s", command),
+			code: 1,
+		}
+	}
+
+	for _, backupPath := range backupPaths {
+		// every shard of a sharded build is locked, as prune removes them
+		// together
+		paths, err := backupFiles(backupPath)
+		if err != nil {
+			return fmt.Errorf("Unable to %s '%s': %s", command, backupPath, err.Error())
+		}
+		for _, path := range paths {
+			err = setLock(path+metaSuffix, unlock, reason)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setLock sets or removes the lock in the metadata file at metaPath
+func setLock(metaPath string, unlock bool, reason string) error {
+	meta, err := readMetaFile(metaPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read metadata file '%s': %s", metaPath, err.Error())
+	}
+	if unlock {
+		meta.Lock = nil
+	} else {
+		meta.Lock = &metaLock{
+			Since:  time.Now().UTC(),
+			Reason: reason,
+		}
+	}
+	err = writeMetaFile(metaPath, meta)
+	if err != nil {
+		return fmt.Errorf("Unable to write metadata file '%s': %s", metaPath, err.Error())
+	}
+	return nil
+}
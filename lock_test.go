@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockShardedBackup(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "b1.tgz")
+	writeShardedBackup(t, base, "one", 3, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+
+	if err := lock([]string{"--reason", "keep", base}, false); err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k < 3; k++ {
+		meta, err := readMetaFile(fmt.Sprintf("%s.%d%s", base, k, metaSuffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Lock == nil || meta.Lock.Reason != "keep" {
+			t.Errorf("shard %d wasn't locked", k)
+		}
+	}
+
+	if err := lock([]string{base}, true); err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k < 3; k++ {
+		meta, err := readMetaFile(fmt.Sprintf("%s.%d%s", base, k, metaSuffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Lock != nil {
+			t.Errorf("shard %d wasn't unlocked", k)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const manifestSuffix = ".manifest"
+
+// manifestEntry is one line of a manifest: an entry of the backup
+type manifestEntry struct {
+	name    string
+	size    int64
+	modTime int64
+}
+
+// formatManifestLine formats an entry as a tab separated manifest line.  Names
+// that would break the format are quoted Go-style.
+func formatManifestLine(entry manifestEntry) string {
+	name := entry.name
+	if strings.ContainsAny(name, "\t\n\r\"\\") {
+		name = strconv.Quote(name)
+	}
+	return fmt.Sprintf("%s\t%d\t%d\n", name, entry.size, entry.modTime)
+}
+
+// writeManifest saves the manifest kept by summary to path
+func writeManifest(path string, summary *buildSummary) error {
+	return os.WriteFile(path, summary.lines.Bytes(), 0666)
+}
+
+// readManifest loads the manifest at path, keyed by name
+func readManifest(path string) (map[string]manifestEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := map[string]manifestEntry{}
+	scanner := bufio.NewScanner(file)
+	for i := 1; scanner.Scan(); i++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected 3 tab separated fields", path, i)
+		}
+		var entry manifestEntry
+		entry.name = fields[0]
+		if strings.HasPrefix(entry.name, "\"") {
+			entry.name, err = strconv.Unquote(entry.name)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: bad name: %s", path, i, err.Error())
+			}
+		}
+		entry.size, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad size: %s", path, i, err.Error())
+		}
+		entry.modTime, err = strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad modification time: %s", path, i, err.Error())
+		}
+		entries[entry.name] = entry
+	}
+	return entries, scanner.Err()
+}
+
+// diffManifests prints what changed between the manifests of two backups,
+// without needing the backups themselves or the files they came from
+func diffManifests(args []string) error {
+	var paths []string
+	for _, arg := range args {
+		switch arg {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup diff-manifests [--help] <old_manifest> <new_manifest>
+
+Compares two manifests written by 'backup build --manifest' and prints one
+line per difference: '+' for added entries, '-' for removed entries, and 'M'
+for entries whose size or modification time changed.`)
+			return nil
+
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) != 2 {
+		return exitError{
+			msg:  "Expected two manifest files to compare",
+			code: 1,
+		}
+	}
+
+	before, err := readManifest(paths[0])
+	if err != nil {
+		return err
+	}
+	after, err := readManifest(paths[1])
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		old, inBefore := before[name]
+		cur, inAfter := after[name]
+		switch {
+		case !inBefore:
+			fmt.Printf("+ %s\t%d\n", name, cur.size)
+		case !inAfter:
+			fmt.Printf("- %s\t%d\n", name, old.size)
+		case old.size != cur.size || old.modTime != cur.modTime:
+			fmt.Printf("M %s\t%d -> %d\n", name, old.size, cur.size)
+		}
+	}
+	return nil
+}
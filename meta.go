@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// metaVersion is bumped whenever the layout of the metadata file changes in a
+// way external tools need to know about
+const metaVersion = 1
+
+// backupMeta is the content of the <output>.meta.json sidecar file.  It lets
+// external tooling inventory backups without opening (or decrypting) them.
+type backupMeta struct {
+	Version    int            `json:"version"`
+	Created    time.Time      `json:"created"`
+	Host       string         `json:"host"`
+	Files      int            `json:"files"`
+	Bytes      int64          `json:"bytes"`
+	Archive    int64          `json:"archive_bytes"`
+	Manifest   string         `json:"manifest_sha256"`
+	Encryption metaEncryption `json:"encryption"`
+	// Lock protects the backup from being pruned while it's set
+	Lock *metaLock `json:"lock,omitempty"`
+	// Shard is set for the archives of a sharded build, which only make a
+	// backup together
+	Shard *metaShard `json:"shard,omitempty"`
+}
+
+// metaShard places an archive among the shards of its build
+type metaShard struct {
+	// Build is shared by every shard of the build
+	Build string `json:"build"`
+	Index int    `json:"index"`
+	Count int    `json:"count"`
+}
+
+// metaLock records why and when a backup was locked
+type metaLock struct {
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// metaEncryption holds the non-secret encryption parameters of an archive
+type metaEncryption struct {
+	Cipher string `json:"cipher"`
+	// KDF is how the key was made: "argon2id" from a password, or "x25519"
+	// when a random key is wrapped for each recipient
+	KDF string `json:"kdf,omitempty"`
+	// the Argon2id parameters, with memory in KiB
+	Time    uint32 `json:"argon2_time,omitempty"`
+	Memory  uint32 `json:"argon2_memory_kib,omitempty"`
+	Threads uint8  `json:"argon2_threads,omitempty"`
+	// Recipients is how many keys can decrypt the archive, with --recipient
+	// or --gpg
+	Recipients int `json:"recipients,omitempty"`
+}
+
+// buildSummary accumulates what went into an archive while it's being built
+type buildSummary struct {
+	files    int
+	bytes    int64
+	manifest hash.Hash
+	// lines holds the manifest itself if it's being kept
+	lines *bytes.Buffer
+}
+
+// newBuildSummary starts a summary, keeping the full manifest only if asked to
+func newBuildSummary(keepManifest bool) *buildSummary {
+	s := &buildSummary{manifest: sha256.New()}
+	if keepManifest {
+		s.lines = &bytes.Buffer{}
+	}
+	return s
+}
+
+// add records an archived entry.  A nil header is ignored so the result of
+// archiveFile can be passed straight in.
+func (s *buildSummary) add(header *tar.Header) {
+	if header == nil {
+		return
+	}
+	s.files++
+	s.bytes += header.Size
+	// one line per entry, in archive order
+	line := formatManifestLine(manifestEntry{
+		name:    header.Name,
+		size:    header.Size,
+		modTime: header.ModTime.Unix(),
+	})
+	s.manifest.Write([]byte(line))
+	if s.lines != nil {
+		s.lines.WriteString(line)
+	}
+}
+
+// writeMeta describes a finished archive, encryption saying how it was
+// encrypted.  shard is nil unless the archive is one shard of a build.
+func writeMeta(path string, summary *buildSummary, archiveSize int64, encryption metaEncryption, shard *metaShard) error {
+	host, _ := os.Hostname()
+	meta := backupMeta{
+		Version:    metaVersion,
+		Created:    time.Now().UTC(),
+		Host:       host,
+		Files:      summary.files,
+		Bytes:      summary.bytes,
+		Archive:    archiveSize,
+		Manifest:   hex.EncodeToString(summary.manifest.Sum(nil)),
+		Encryption: encryption,
+		Shard:      shard,
+	}
+
+	return writeMetaFile(path, meta)
+}
+
+// readMetaFile loads the metadata file at path
+func readMetaFile(path string) (backupMeta, error) {
+	var meta backupMeta
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// writeMetaFile saves meta to the metadata file at path
+func writeMetaFile(path string, meta backupMeta) error {
+	data, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0666)
+}
+
+// countingWriter counts the bytes that pass through it.  If total is set, it
+// is also atomically increased so writers can share a count.
+type countingWriter struct {
+	w     io.Writer
+	n     int64
+	total *int64
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	n, err := c.w.Write(data)
+	c.n += int64(n)
+	if c.total != nil {
+		atomic.AddInt64(c.total, int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// snapshotFormat names the snapshot directories of a mirror, it sorts in
+// chronological order
+const snapshotFormat = "2006-01-02T150405"
+
+// writeMirror copies selected into a new snapshot directory under dir, using
+// hardlinks into the previous snapshot for files that haven't changed (like
+// rsync --link-dest).  The snapshot only gets its final name once it's
+// complete, and dir/latest is pointed at it.
+func writeMirror(dir string, selected selection, opts *buildOptions) error {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+	previous, err := latestSnapshot(dir)
+	if err != nil {
+		return err
+	}
+
+	name := time.Now().Format(snapshotFormat)
+	final := filepath.Join(dir, name)
+	if _, err := os.Lstat(final); err == nil {
+		return fmt.Errorf("Snapshot '%s' already exists", final)
+	}
+	partial := filepath.Join(dir, "."+name+".partial")
+	err = os.RemoveAll(partial)
+	if err != nil {
+		return err
+	}
+	// a snapshot that doesn't get its final name isn't left behind
+	defer os.RemoveAll(partial)
+
+	// stopped is set when the snapshot grows past --max-size, which still
+	// finishes the snapshot with what was copied so far
+	var stopped error
+	var copied, linked int
+	for _, file := range selected.files {
+		opts.progress.starting(file.path)
+		wasLinked, err := mirrorFile(file, partial, previous, opts)
+		if err != nil {
+			return err
+		}
+		opts.progress.done(mirroredHeader(file.path))
+		if wasLinked {
+			linked++
+		} else {
+			copied++
+		}
+		if stopped = opts.checkMaxSize(file.path); stopped != nil {
+			break
+		}
+	}
+	for _, repo := range selected.gitRepos {
+		if stopped != nil {
+			break
+		}
+		opts.progress.starting(repo.path)
+		err = mirrorGitBundle(repo, partial, opts)
+		if err != nil {
+			return err
+		}
+		opts.progress.done(&tar.Header{})
+		copied++
+		stopped = opts.checkMaxSize(repo.path)
+	}
+
+	// an empty selection still makes a snapshot
+	err = os.MkdirAll(partial, 0777)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(partial, final)
+	if err != nil {
+		return err
+	}
+
+	latest := filepath.Join(dir, "latest")
+	os.Remove(latest)
+	err = os.Symlink(name, latest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to point '%s' at the new snapshot: %s\n", latest, err.Error())
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote snapshot '%s': %d files copied, %d linked to the previous snapshot\n", final, copied, linked)
+	return stopped
+}
+
+// mirroredHeader stands in for the header of a file copied into a mirror,
+// for the progress, which only needs its size
+func mirroredHeader(path string) *tar.Header {
+	header := &tar.Header{}
+	if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+		header.Size = info.Size()
+	}
+	return header
+}
+
+// latestSnapshot finds the newest complete snapshot in dir, returning "" if
+// there isn't one
+func latestSnapshot(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(snapshotFormat, entry.Name()); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	sort.Strings(names)
+	return filepath.Join(dir, names[len(names)-1]), nil
+}
+
+// mirrorDest is where a file named name is stored in the snapshot at root
+func mirrorDest(root string, name string) string {
+	return filepath.Join(root, strings.TrimPrefix(filepath.Clean(name), "/"))
+}
+
+// mirrorFile stores one file in the snapshot at root.  Regular files that are
+// unchanged since the previous snapshot are hardlinked to it, which is
+// reported by the returned bool.  Files that can't be read are skipped.
+// Copied bytes count towards --max-size, linked ones take up no more space.
+func mirrorFile(file selectedFile, root string, previous string, opts *buildOptions) (bool, error) {
+	path := file.path
+	info, err := os.Lstat(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to stat '%s': %s\n", path, err.Error())
+		return false, nil
+	}
+	dest := mirrorDest(root, file.name)
+	err = os.MkdirAll(filepath.Dir(dest), 0777)
+	if err != nil {
+		return false, err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read link '%s': %s\n", path, err.Error())
+			return false, nil
+		}
+		return false, os.Symlink(target, dest)
+	}
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+
+	if previous != "" {
+		prev := mirrorDest(previous, file.name)
+		prevInfo, err := os.Lstat(prev)
+		if err == nil && prevInfo.Mode().IsRegular() && prevInfo.Size() == info.Size() &&
+			prevInfo.ModTime().Equal(info.ModTime()) && prevInfo.Mode().Perm() == info.Mode().Perm() {
+			if err = os.Link(prev, dest); err == nil {
+				return true, nil
+			}
+			// fall back to copying, e.g. when over the link count limit
+		}
+	}
+
+	started := time.Now()
+	src, err := openRetrying(path, opts)
+	opts.throttle.observe(time.Since(started))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open '%s': %s\n", path, err.Error())
+		return false, nil
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(&countingWriter{w: dst, total: &opts.written}, src)
+	if err != nil {
+		dst.Close()
+		return false, fmt.Errorf("Error copying '%s': %s", path, err.Error())
+	}
+	err = dst.Close()
+	if err != nil {
+		return false, err
+	}
+	// the umask may have stripped permission bits
+	err = os.Chmod(dest, info.Mode().Perm())
+	if err != nil {
+		return false, err
+	}
+	return false, os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
+
+// mirrorGitBundle stores the history of the work tree at repo as a bundle in
+// the snapshot at root
+func mirrorGitBundle(repo selectedFile, root string, opts *buildOptions) error {
+	dest := mirrorDest(root, filepath.Join(repo.name, gitBundleName))
+	err := os.MkdirAll(filepath.Dir(dest), 0777)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("git", "-C", repo.path, "bundle", "create", "--quiet", dest, "--all")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to bundle git repository '%s': %s\n%s", repo.path, err.Error(), out)
+	} else if info, err := os.Stat(dest); err == nil {
+		atomic.AddInt64(&opts.written, info.Size())
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteMirrorRemovesFailedSnapshot(t *testing.T) {
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "file")
+	if err := os.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(tmp, "link")
+	if err := os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+	// the symlink can't be stored under the name the file already took
+	selected := selection{files: []selectedFile{
+		{path: file, name: "same"},
+		{path: link, name: "same"},
+	}}
+
+	dir := filepath.Join(tmp, "mirror")
+	opts := buildOptions{progress: newProgress(len(selected.files), sizeEstimate{})}
+	if err := writeMirror(dir, selected, &opts); err == nil {
+		t.Fatal("stored two entries under one name")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".partial") {
+			t.Errorf("the failed snapshot '%s' was left behind", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// networkFilesystems are the filesystem types that live on another machine,
+// where a walk can stall for as long as the server is unreachable.  autofs is
+// included because walking into an automount point is what mounts the share.
+var networkFilesystems = map[string]bool{
+	"nfs":        true,
+	"nfs4":       true,
+	"cifs":       true,
+	"smb3":       true,
+	"smbfs":      true,
+	"ncpfs":      true,
+	"afs":        true,
+	"9p":         true,
+	"ceph":       true,
+	"glusterfs":  true,
+	"lustre":     true,
+	"fuse.sshfs": true,
+	"autofs":     true,
+}
+
+// mountTable maps mount points to their filesystem types
+type mountTable map[string]string
+
+// readMounts reads the mount table of this process.  It's read from the
+// kernel's list rather than by running statfs on each directory, since statfs
+// on a hung network mount blocks just like walking it would.
+func readMounts() (mountTable, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mounts := mountTable{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// the mount point is the fifth field, and the type follows the
+		// optional fields' '-' separator
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		for i := 5; i+1 < len(fields); i++ {
+			if fields[i] == "-" {
+				mounts[unescapeMountPath(fields[4])] = fields[i+1]
+				break
+			}
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath undoes the octal escapes the kernel uses for spaces, tabs,
+// newlines, and backslashes in mount points
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// networkMount returns the filesystem type of dir if it's the mount point of a
+// network filesystem
+func (m mountTable) networkMount(dir string) (string, bool) {
+	fstype, ok := m[dir]
+	return fstype, ok && networkFilesystems[fstype]
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileID identifies a file regardless of the path it was reached by
+type fileID struct {
+	dev, ino uint64
+}
+
+// filesOpenForWriting scans every process's open file descriptors for
+// regular files that are open for writing.  Processes that can't be
+// inspected, usually other users' when not running as root, are passed over.
+func filesOpenForWriting() map[fileID]bool {
+	open := map[fileID]bool{}
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return open
+	}
+	self := strconv.Itoa(os.Getpid())
+	for _, proc := range procs {
+		pid := proc.Name()
+		if _, err := strconv.Atoi(pid); err != nil || pid == self {
+			continue
+		}
+		fdDir := filepath.Join("/proc", pid, "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if !openForWriting(filepath.Join("/proc", pid, "fdinfo", fd.Name())) {
+				continue
+			}
+			// stat follows the descriptor to the file itself
+			var info unix.Stat_t
+			err := unix.Stat(filepath.Join(fdDir, fd.Name()), &info)
+			if err != nil || info.Mode&unix.S_IFMT != unix.S_IFREG {
+				continue
+			}
+			open[fileID{dev: info.Dev, ino: info.Ino}] = true
+		}
+	}
+	return open
+}
+
+// openForWriting reads a descriptor's fdinfo to see if it was opened with
+// write access
+func openForWriting(fdinfo string) bool {
+	data, err := os.ReadFile(fdinfo)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "flags:") {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimSpace(line[len("flags:"):]), 8, 64)
+		if err != nil {
+			return false
+		}
+		mode := flags & unix.O_ACCMODE
+		return mode == unix.O_WRONLY || mode == unix.O_RDWR
+	}
+	return false
+}
+
+// idOf returns the identity of the file at path, without following symlinks
+func idOf(path string) (fileID, bool) {
+	var info unix.Stat_t
+	err := unix.Lstat(path, &info)
+	if err != nil {
+		return fileID{}, false
+	}
+	return fileID{dev: info.Dev, ino: info.Ino}, true
+}
+
+// checkOpenFiles looks for selected files that another process has open for
+// writing, warning about each and, with skip set, leaving them out
+func checkOpenFiles(selected *selection, skip bool) {
+	open := filesOpenForWriting()
+	if len(open) == 0 {
+		return
+	}
+	kept := selected.files[:0]
+	for _, file := range selected.files {
+		id, ok := idOf(file.path)
+		if !ok || !open[id] {
+			kept = append(kept, file)
+			continue
+		}
+		if skip {
+			fmt.Fprintf(os.Stderr, "Warning: skipping '%s', it's open for writing\n", file.path)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Warning: '%s' is open for writing and may be archived half written\n", file.path)
+		kept = append(kept, file)
+	}
+	selected.files = kept
+}
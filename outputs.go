@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// destination is one file an archive is written to
+type destination struct {
+	path string
+	file *os.File
+	// err is set once writing to the destination fails, after which it's no
+	// longer written to
+	err error
+}
+
+// fanout writes to every destination that hasn't failed yet, so one bad
+// output doesn't stop the others from being written
+type fanout struct {
+	dests []*destination
+}
+
+// openOutputs opens each of paths for writing.  With no paths, stdout is the
+// only destination.  Failing to open a path is recorded on its destination.
+func openOutputs(paths []string) *fanout {
+	if len(paths) == 0 {
+		return &fanout{dests: []*destination{{path: "stdout", file: os.Stdout}}}
+	}
+	out := &fanout{}
+	for _, outPath := range paths {
+		dest := &destination{path: outPath}
+		dest.file, dest.err = os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		out.dests = append(out.dests, dest)
+	}
+	return out
+}
+
+// Write writes data to each working destination, it only fails once every
+// destination has failed
+func (f *fanout) Write(data []byte) (int, error) {
+	var firstErr error
+	written := false
+	for _, dest := range f.dests {
+		if dest.err == nil {
+			_, dest.err = dest.file.Write(data)
+			written = written || dest.err == nil
+		}
+		if dest.err != nil && firstErr == nil {
+			firstErr = dest.err
+		}
+	}
+	if !written {
+		if firstErr == nil {
+			firstErr = errors.New("no outputs to write to")
+		}
+		return 0, firstErr
+	}
+	return len(data), nil
+}
+
+// discard closes and removes every opened destination file, for an archive
+// that was abandoned partway.  Standard out is left alone.
+func (f *fanout) discard() {
+	for _, dest := range f.dests {
+		if dest.file == nil || dest.file == os.Stdout {
+			continue
+		}
+		dest.file.Close()
+		os.Remove(dest.path)
+		dest.file = nil
+	}
+}
+
+// close closes every opened destination file, recording any error
+func (f *fanout) close() {
+	for _, dest := range f.dests {
+		if dest.file == nil || dest.file == os.Stdout {
+			continue
+		}
+		err := dest.file.Close()
+		if dest.err == nil {
+			dest.err = err
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// owners decides who owns restored files.  Names in the backup are looked up
+// on this system, and the uid and gid stored alongside them are used when a
+// name doesn't exist here or numeric is set.  Either way the ids can then be
+// mapped to different ones.
+type owners struct {
+	numeric bool
+	// uidMap and gidMap replace the ids on the left with those on the right
+	uidMap map[int]int
+	gidMap map[int]int
+	// looked up names, -1 for names that don't exist
+	users  map[string]int
+	groups map[string]int
+}
+
+func newOwners() *owners {
+	return &owners{
+		uidMap: map[int]int{},
+		gidMap: map[int]int{},
+		users:  map[string]int{},
+		groups: map[string]int{},
+	}
+}
+
+// ids returns the uid and gid the entry described by header is given
+func (o *owners) ids(header *tar.Header) (int, int) {
+	uid, gid := header.Uid, header.Gid
+	if !o.numeric {
+		if id := o.lookup(o.users, header.Uname, lookupUser); id >= 0 {
+			uid = id
+		}
+		if id := o.lookup(o.groups, header.Gname, lookupGroup); id >= 0 {
+			gid = id
+		}
+	}
+	if mapped, ok := o.uidMap[uid]; ok {
+		uid = mapped
+	}
+	if mapped, ok := o.gidMap[gid]; ok {
+		gid = mapped
+	}
+	return uid, gid
+}
+
+// lookup finds the id of name with find, remembering the answer in cache
+func (o *owners) lookup(cache map[string]int, name string, find func(string) (int, error)) int {
+	if name == "" {
+		return -1
+	}
+	id, ok := cache[name]
+	if !ok {
+		var err error
+		id, err = find(name)
+		if err != nil {
+			id = -1
+		}
+		cache[name] = id
+	}
+	return id
+}
+
+func lookupUser(name string) (int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func lookupGroup(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// parseIDMapping parses an OLD:NEW pair of numeric ids into mapping
+func parseIDMapping(s string, mapping map[int]int) error {
+	from, to, found := strings.Cut(s, ":")
+	if !found {
+		return fmt.Errorf("expected OLD:NEW")
+	}
+	old, err := strconv.Atoi(from)
+	if err != nil || old < 0 {
+		return fmt.Errorf("'%s' isn't an id", from)
+	}
+	replacement, err := strconv.Atoi(to)
+	if err != nil || replacement < 0 {
+		return fmt.Errorf("'%s' isn't an id", to)
+	}
+	mapping[old] = replacement
+	return nil
+}
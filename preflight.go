@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// preflight checks that every selected file can be read the way archiving
+// will read it, and describes each one that can't
+func preflight(selected selection) []string {
+	var problems []string
+	for _, selected := range selected.files {
+		path := selected.path
+		info, err := os.Lstat(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Unable to stat '%s': %s", path, err.Error()))
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			// everything but regular files is archived from its metadata alone
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Unable to open '%s': %s", path, err.Error()))
+			continue
+		}
+		file.Close()
+	}
+	for _, repo := range selected.gitRepos {
+		_, err := os.Stat(filepath.Join(repo.path, ".git"))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Unable to read git repository '%s': %s", repo.path, err.Error()))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// statusInterval is how often the status file is rewritten during a build
+const statusInterval = time.Second
+
+// progress tracks how far along a build is.  It's shared by every archive
+// being written.
+type progress struct {
+	mu     sync.Mutex
+	status buildStatus
+}
+
+// buildStatus is a snapshot of a build's progress, as stored in the status
+// file
+type buildStatus struct {
+	PID        int       `json:"pid"`
+	Started    time.Time `json:"started"`
+	Updated    time.Time `json:"updated"`
+	FilesDone  int       `json:"files_done"`
+	FilesTotal int       `json:"files_total"`
+	BytesDone  int64     `json:"bytes_done"`
+	BytesTotal int64     `json:"bytes_total"`
+	// BytesAllocated is how much disk the files take up, less than
+	// BytesTotal when some are sparse
+	BytesAllocated int64 `json:"bytes_allocated"`
+	// Phase is what the build is doing before it starts archiving
+	Phase    string `json:"phase,omitempty"`
+	Current  string `json:"current"`
+	Errors   int    `json:"errors"`
+	Finished bool   `json:"finished"`
+	Failed   string `json:"failed,omitempty"`
+}
+
+func newProgress(filesTotal int, estimate sizeEstimate) *progress {
+	return &progress{status: buildStatus{
+		PID:            os.Getpid(),
+		Started:        time.Now(),
+		FilesTotal:     filesTotal,
+		BytesTotal:     estimate.apparent,
+		BytesAllocated: estimate.allocated,
+	}}
+}
+
+// setPhase records what the build is doing, "" once it's archiving
+func (p *progress) setPhase(phase string) {
+	p.mu.Lock()
+	p.status.Phase = phase
+	p.status.Current = ""
+	p.mu.Unlock()
+}
+
+// setTotals records how much there is to archive, once it's known
+func (p *progress) setTotals(filesTotal int, estimate sizeEstimate) {
+	p.mu.Lock()
+	p.status.FilesTotal = filesTotal
+	p.status.BytesTotal = estimate.apparent
+	p.status.BytesAllocated = estimate.allocated
+	p.mu.Unlock()
+}
+
+// starting records that path is being archived, or looked at while selecting
+// files
+func (p *progress) starting(path string) {
+	p.mu.Lock()
+	p.status.Current = path
+	p.mu.Unlock()
+}
+
+// done records that a file has been dealt with, a nil header meaning it
+// couldn't be archived.  Mirrors pass a header with just the size.
+func (p *progress) done(header *tar.Header) {
+	p.mu.Lock()
+	p.status.FilesDone++
+	if header == nil {
+		p.status.Errors++
+	} else {
+		p.status.BytesDone += header.Size
+	}
+	p.mu.Unlock()
+}
+
+// finish records the end of the build, err being why it failed if it did
+func (p *progress) finish(err error) {
+	p.mu.Lock()
+	p.status.Finished = true
+	p.status.Current = ""
+	if err != nil {
+		p.status.Failed = err.Error()
+	}
+	p.mu.Unlock()
+}
+
+func (p *progress) snapshot() buildStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := p.status
+	status.Updated = time.Now()
+	return status
+}
+
+// reportOnSignal prints the progress to standard error every time the process
+// gets SIGUSR1, until stop is closed
+func (p *progress) reportOnSignal(stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-signals:
+			fmt.Fprintln(os.Stderr, p.snapshot().String())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// watch rewrites the status file at path until stop is closed, then writes it
+// one last time and closes done
+func (p *progress) watch(path string, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	for {
+		err := writeStatusFile(path, p.snapshot())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write status file '%s': %s\n", path, err.Error())
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			err = writeStatusFile(path, p.snapshot())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to write status file '%s': %s\n", path, err.Error())
+			}
+			return
+		}
+	}
+}
+
+// writeStatusFile replaces the status file at path, going through a
+// temporary file so readers never see half of it
+func writeStatusFile(path string, status buildStatus) error {
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// String describes the progress for people
+func (s buildStatus) String() string {
+	state := "running"
+	if s.Phase != "" {
+		state += ", " + s.Phase
+	}
+	if s.Failed != "" {
+		state = "failed: " + s.Failed
+	} else if s.Finished {
+		state = "finished"
+	}
+	text := fmt.Sprintf("Build %d %s, started %s\n", s.PID, state, s.Started.Format(time.RFC1123))
+	text += fmt.Sprintf("Files: %d of %d\n", s.FilesDone, s.FilesTotal)
+	// the total is only estimated when there's a status file
+	if s.BytesTotal == 0 {
+		text += fmt.Sprintf("Bytes: %s", humanSize(s.BytesDone))
+	} else {
+		text += fmt.Sprintf("Bytes: %s of %s", humanSize(s.BytesDone), humanSize(s.BytesTotal))
+	}
+	if s.BytesAllocated < s.BytesTotal {
+		text += fmt.Sprintf(" (%s allocated)", humanSize(s.BytesAllocated))
+	}
+	text += "\n"
+	text += fmt.Sprintf("Errors: %d\n", s.Errors)
+	if s.Current != "" {
+		text += fmt.Sprintf("Current: %s\n", s.Current)
+	}
+	text += fmt.Sprintf("Updated: %s", s.Updated.Format(time.RFC1123))
+	return text
+}
+
+// status prints the progress recorded in a build's status file
+func status(args []string) error {
+	var statusPath string
+	for _, arg := range args {
+		switch arg {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup status [--help] <status_file>
+
+Prints the progress of a build started with '--status-file', or how it
+ended.`)
+			return nil
+
+		default:
+			if statusPath != "" {
+				return exitError{
+					msg:  "Can only show one status file at a time",
+					code: 1,
+				}
+			}
+			statusPath = arg
+		}
+	}
+	if statusPath == "" {
+		return exitError{
+			msg:  "Expected a status file",
+			code: 1,
+		}
+	}
+
+	data, err := os.ReadFile(statusPath)
+	if err != nil {
+		return err
+	}
+	var s buildStatus
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("Unable to read status file '%s': %s", statusPath, err.Error())
+	}
+	fmt.Println(s.String())
+	if !s.Finished && time.Since(s.Updated) > 10*statusInterval {
+		fmt.Println("The status hasn't been updated recently, the build may have been killed")
+	}
+	return nil
+}
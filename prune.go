@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const metaSuffix = ".meta.json"
+
+// trashDir is where pruned backups wait out their grace period, inside the
+// directory being pruned
+const trashDir = ".trash"
+
+// trashFormat names the directory each prune moves its backups into, so the
+// time they were trashed is known
+const trashFormat = "2006-01-02T150405.000"
+
+// sidecarSuffixes are the files that can accompany a backup and go wherever
+// it goes
+var sidecarSuffixes = []string{metaSuffix, manifestSuffix, sigSuffix}
+
+// storedBackup is a backup found in a destination directory.  The shards of
+// a sharded build are one backup, kept or removed together.
+type storedBackup struct {
+	// path names the backup, for a sharded build it's the output path
+	// without a shard's index
+	path string
+	// files are the backup's archives, one per shard
+	files []string
+	// meta is that of the first shard found, locked if any shard is.  For
+	// a backup without a metadata file, only Created is set, from its name.
+	meta backupMeta
+	// profile groups the backups that retention is applied to together:
+	// the file name with its date and time replaced by *, or "" for
+	// backups with metadata files and no date in their name
+	profile string
+	// size includes the sidecar files
+	size int64
+}
+
+func prune(args []string) error {
+	var dir string
+	var maxTotal int64 = -1
+	keepMin := 1
+	dryRun := false
+	emptyTrash := false
+	grace := 7 * 24 * time.Hour
+	var keep retention
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup prune [--help] [--max-total-size SIZE] [--keep-last N]
+	             [--keep-daily N] [--keep-weekly N] [--keep-min N]
+	             [--grace DURATION] [--dry-run] <dir>
+	backup prune [--help] --empty-trash <dir>
+
+Removes old backups from a directory.  Backups built with '--meta' are
+identified by their metadata files, which record when they were made.  Other
+backups are recognized by the date and time in their file names, as in
+home-2024-05-01T120000.tgz, home-20240501-1200.tgz, or
+home-2024-05-01_12-00-00.tgz, and by being gzipped or encrypted.  Backups locked
+with 'backup lock' are never removed.  The shards of a build made with
+--shards count as one backup, and are removed together.
+
+Backups whose names only differ in their date and time make up a profile, and
+the --keep options and --keep-min apply to each profile on its own, so
+home-*.tgz and etc-*.tgz each keep their newest backups.  Backups with
+metadata files and no date in their names make up one profile.
+
+With any of the --keep options, every backup that none of them keep is
+removed.  --keep-daily keeps the newest backup of each of the last N days that
+have one, and --keep-weekly does the same for weeks starting on Monday.  Then,
+with --max-total-size, the oldest backups left are removed, kept or not, until
+they take up no more than SIZE bytes.  SIZE may end in K, M, G, or T.
+
+Removed backups are moved into the directory's .trash and only deleted once
+they've been there for the grace period, so a retention mistake can be undone
+by moving them back.  Each prune deletes the trash that has expired.
+
+Options:
+	-h, --help          this help message
+	--max-total-size    the budget for all backups in the directory
+	--keep-last         keep the newest N backups
+	--keep-daily        keep the newest backup of each of the last N days
+	--keep-weekly       keep the newest backup of each of the last N weeks
+	--keep-min          never remove the newest N backups, defaults to 1
+	--grace             how long removed backups stay in the trash, such as
+	                    12h, 7d, or 2w; defaults to 7d, 0 deletes immediately
+	--empty-trash       delete everything in the trash now
+	--dry-run           print what would be removed without removing it`)
+			return nil
+
+		case "--max-total-size":
+			s := tryGetArg(args, i+1)
+			size, err := parseSize(s)
+			if err != nil {
+				return exitError{
+					msg:  fmt.Sprintf("Bad size after '%s': %s", args[i], err.Error()),
+					code: 1,
+				}
+			}
+			maxTotal = size
+			i++
+		case "--keep-min":
+			n, err := strconv.Atoi(tryGetArg(args, i+1))
+			if err != nil || n < 0 {
+				return exitError{
+					msg:  fmt.Sprintf("Expected a count after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			keepMin = n
+			i++
+		case "--keep-last", "--keep-daily", "--keep-weekly":
+			n, err := strconv.Atoi(tryGetArg(args, i+1))
+			if err != nil || n < 0 {
+				return exitError{
+					msg:  fmt.Sprintf("Expected a count after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			switch args[i] {
+			case "--keep-last":
+				keep.last = n
+			case "--keep-daily":
+				keep.daily = n
+			default:
+				keep.weekly = n
+			}
+			keep.set = true
+			i++
+		case "--grace":
+			d, err := parseDuration(tryGetArg(args, i+1))
+			if err != nil || d < 0 {
+				return exitError{
+					msg:  fmt.Sprintf("Expected a duration after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			grace = d
+			i++
+		case "--empty-trash":
+			emptyTrash = true
+		case "--dry-run":
+			dryRun = true
+		default:
+			if dir != "" {
+				return exitError{
+					msg:  "Can only prune one directory at a time",
+					code: 1,
+				}
+			}
+			dir = args[i]
+		}
+	}
+	if dir == "" || (maxTotal < 0 && !keep.set && !emptyTrash) {
+		return exitError{
+			msg:  "Expected --max-total-size, a --keep option, or --empty-trash, and a directory to prune",
+			code: 1,
+		}
+	}
+
+	if emptyTrash {
+		return purgeTrash(dir, 0, dryRun)
+	}
+	err := purgeTrash(dir, grace, dryRun)
+	if err != nil {
+		return err
+	}
+
+	backups, err := findStoredBackups(dir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, b := range backups {
+		total += b.size
+	}
+
+	// everything pruned in this run shares a trash directory
+	trash := filepath.Join(dir, trashDir, time.Now().UTC().Format(trashFormat))
+
+	discard := func(b storedBackup) error {
+		switch {
+		case dryRun:
+			fmt.Printf("would remove %s (%d bytes)\n", b.path, b.size)
+		case grace == 0:
+			err := removeStoredBackup(b)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("deleted %s (%d bytes)\n", b.path, b.size)
+		default:
+			err := trashStoredBackup(b, trash)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("moved %s to the trash (%d bytes)\n", b.path, b.size)
+		}
+		total -= b.size
+		return nil
+	}
+
+	var remaining []storedBackup
+	for _, profile := range groupByProfile(backups) {
+		// backups are sorted oldest first, and the newest keepMin of each
+		// profile are never candidates
+		candidates := profile
+		if len(candidates) > keepMin {
+			candidates = candidates[:len(candidates)-keepMin]
+		} else {
+			candidates = nil
+		}
+
+		kept := keep.apply(profile)
+		for i, b := range candidates {
+			if b.meta.Lock != nil {
+				continue
+			}
+			if keep.set && !kept[i] {
+				err = discard(b)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			remaining = append(remaining, b)
+		}
+	}
+	// the budget removes the oldest first, whatever their profile
+	sort.SliceStable(remaining, func(i, j int) bool {
+		return remaining[i].meta.Created.Before(remaining[j].meta.Created)
+	})
+
+	for i := 0; maxTotal >= 0 && total > maxTotal && i < len(remaining); i++ {
+		err = discard(remaining[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	if maxTotal >= 0 && total > maxTotal {
+		return exitError{
+			msg:  fmt.Sprintf("Backups in '%s' still take %d bytes, over the budget of %d", dir, total, maxTotal),
+			code: 3,
+		}
+	}
+	return nil
+}
+
+// findStoredBackups lists the backups in dir, oldest first, with the shards
+// of each sharded build as one backup.  Backups are those with a metadata
+// file, and those without one that have a date and time in their name.
+func findStoredBackups(dir string) ([]storedBackup, error) {
+	metaPaths, err := filepath.Glob(filepath.Join(dir, "*"+metaSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []storedBackup
+	// builds indexes the sharded backups by their build id
+	builds := map[string]int{}
+	for _, metaPath := range metaPaths {
+		b := storedBackup{path: strings.TrimSuffix(metaPath, metaSuffix)}
+		b.files = []string{b.path}
+		info, err := os.Stat(b.path)
+		if err != nil {
+			// metadata left behind without its backup
+			continue
+		}
+		b.meta, err = readMetaFile(metaPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring unreadable metadata file '%s': %s\n", metaPath, err.Error())
+			continue
+		}
+		b.size = info.Size()
+		for _, suffix := range sidecarSuffixes {
+			if sidecar, err := os.Stat(b.path + suffix); err == nil {
+				b.size += sidecar.Size()
+			}
+		}
+		if shard := b.meta.Shard; shard != nil && shard.Build != "" {
+			if i, ok := builds[shard.Build]; ok {
+				backups[i].files = append(backups[i].files, b.path)
+				backups[i].size += b.size
+				if backups[i].meta.Lock == nil {
+					backups[i].meta.Lock = b.meta.Lock
+				}
+				continue
+			}
+			builds[shard.Build] = len(backups)
+			b.path = strings.TrimSuffix(b.path, fmt.Sprintf(".%d", shard.Index))
+		}
+		if profile, _, ok := parseBackupName(filepath.Base(b.path)); ok {
+			b.profile = profile
+		}
+		backups = append(backups, b)
+	}
+
+	named, err := findNamedBackups(dir)
+	if err != nil {
+		return nil, err
+	}
+	backups = append(backups, named...)
+
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].meta.Created.Before(backups[j].meta.Created)
+	})
+	return backups, nil
+}
+
+// shardSuffix matches the index a shard adds to its output's name
+var shardSuffix = regexp.MustCompile(`\.[0-9]+$`)
+
+// findNamedBackups lists the backups in dir that have no metadata file but
+// have a date and time in their name, going by the name for when they were
+// made.  Shards without metadata files are grouped by their output's name.
+func findNamedBackups(dir string) ([]storedBackup, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []storedBackup
+	// outputs indexes the backups by their path, for their other shards
+	outputs := map[string]int{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || isSidecar(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if _, err := os.Stat(path + metaSuffix); err == nil {
+			continue
+		}
+		output := path
+		if suffix := shardSuffix.FindString(entry.Name()); suffix != "" {
+			output = strings.TrimSuffix(path, suffix)
+		}
+		profile, created, ok := parseBackupName(filepath.Base(output))
+		if !ok || !looksLikeBackup(path) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		size := info.Size()
+		for _, suffix := range sidecarSuffixes {
+			if sidecar, err := os.Stat(path + suffix); err == nil {
+				size += sidecar.Size()
+			}
+		}
+		if i, ok := outputs[output]; ok {
+			backups[i].files = append(backups[i].files, path)
+			backups[i].size += size
+			continue
+		}
+		outputs[output] = len(backups)
+		backups = append(backups, storedBackup{
+			path:    output,
+			files:   []string{path},
+			meta:    backupMeta{Created: created},
+			profile: profile,
+			size:    size,
+		})
+	}
+	return backups, nil
+}
+
+// isSidecar reports whether name is one of the files that accompany a backup
+func isSidecar(name string) bool {
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// looksLikeBackup reports whether the file at path starts the way backups
+// do: gzipped, encrypted by backup, or encrypted by gpg
+func looksLikeBackup(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return true
+	}
+	return isEncrypted(r) || isGPGMessage(r)
+}
+
+// nameTimestamp matches the dates, with an optional time, that 'date' and
+// the like put in file names: 2024-05-01T120000, 2024-05-01_12-00-00,
+// 20240501-1200, or just 2024-05-01
+var nameTimestamp = regexp.MustCompile(`([0-9]{4})-?([0-9]{2})-?([0-9]{2})(?:[T_ -]?([0-9]{2})[:-]?([0-9]{2})(?:[:-]?([0-9]{2}))?)?`)
+
+// parseBackupName finds the last date and time in a backup's file name.  It
+// returns the name's profile, the name with the date and time replaced by *,
+// and the time in the local time zone.
+func parseBackupName(name string) (string, time.Time, bool) {
+	matches := nameTimestamp.FindAllStringSubmatchIndex(name, -1)
+	for m := len(matches) - 1; m >= 0; m-- {
+		match := matches[m]
+		start, end := match[0], match[1]
+		// part of a longer number isn't a date
+		if start > 0 && isDigit(name[start-1]) || end < len(name) && isDigit(name[end]) {
+			continue
+		}
+		var fields [6]int
+		for i := range fields {
+			if match[2+2*i] >= 0 {
+				fields[i], _ = strconv.Atoi(name[match[2+2*i]:match[3+2*i]])
+			}
+		}
+		t := time.Date(fields[0], time.Month(fields[1]), fields[2], fields[3], fields[4], fields[5], 0, time.Local)
+		if t.Month() != time.Month(fields[1]) || t.Day() != fields[2] || t.Hour() != fields[3] ||
+			t.Minute() != fields[4] || t.Second() != fields[5] {
+			// out of range, so not a date after all
+			continue
+		}
+		return name[:start] + "*" + name[end:], t, true
+	}
+	return "", time.Time{}, false
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// groupByProfile splits backups, sorted oldest first, by their profiles,
+// keeping them sorted
+func groupByProfile(backups []storedBackup) [][]storedBackup {
+	var groups [][]storedBackup
+	index := map[string]int{}
+	for _, b := range backups {
+		i, ok := index[b.profile]
+		if !ok {
+			i = len(groups)
+			index[b.profile] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], b)
+	}
+	return groups
+}
+
+// removeStoredBackup deletes each of a backup's archives and then its
+// sidecar files
+func removeStoredBackup(b storedBackup) error {
+	for _, file := range b.files {
+		err := os.Remove(file)
+		if err != nil {
+			return err
+		}
+		for _, suffix := range sidecarSuffixes {
+			err = os.Remove(file + suffix)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// trashStoredBackup moves a backup's archives and their sidecar files into
+// trash.  Metadata files go last so an interrupted move never leaves an
+// archive that prune can't recognize.
+func trashStoredBackup(b storedBackup, trash string) error {
+	err := os.MkdirAll(trash, 0777)
+	if err != nil {
+		return err
+	}
+	for _, file := range b.files {
+		base := filepath.Base(file)
+		err = os.Rename(file, filepath.Join(trash, base))
+		if err != nil {
+			return err
+		}
+		for i := len(sidecarSuffixes) - 1; i >= 0; i-- {
+			suffix := sidecarSuffixes[i]
+			err = os.Rename(file+suffix, filepath.Join(trash, base+suffix))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// purgeTrash deletes whatever has been in dir's trash for longer than grace
+func purgeTrash(dir string, grace time.Duration, dryRun bool) error {
+	trashRoot := filepath.Join(dir, trashDir)
+	entries, err := os.ReadDir(trashRoot)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		trashed, err := time.Parse(trashFormat, entry.Name())
+		if err != nil || !entry.IsDir() {
+			// not something prune put there
+			continue
+		}
+		if time.Since(trashed) < grace {
+			continue
+		}
+		trash := filepath.Join(trashRoot, entry.Name())
+		if dryRun {
+			fmt.Printf("would empty %s\n", trash)
+			continue
+		}
+		err = os.RemoveAll(trash)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("emptied %s\n", trash)
+	}
+	return nil
+}
+
+// retention is which backups the --keep options hold on to
+type retention struct {
+	// set is true if any --keep option was given
+	set                 bool
+	last, daily, weekly int
+}
+
+// apply returns which of backups, sorted oldest first, are kept, by index
+func (r retention) apply(backups []storedBackup) map[int]bool {
+	kept := map[int]bool{}
+	for i := len(backups) - 1; i >= 0 && i >= len(backups)-r.last; i-- {
+		kept[i] = true
+	}
+
+	// keepNewestPer keeps the newest backup in each of the last n periods,
+	// period naming the one a time falls in
+	keepNewestPer := func(n int, period func(time.Time) string) {
+		var last string
+		for i := len(backups) - 1; i >= 0 && n > 0; i-- {
+			p := period(backups[i].meta.Created.Local())
+			if p == last {
+				continue
+			}
+			kept[i] = true
+			last = p
+			n--
+		}
+	}
+	keepNewestPer(r.daily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepNewestPer(r.weekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	return kept
+}
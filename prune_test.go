@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeShardedBackup writes the archives and metadata files of a build split
+// into count shards
+func writeShardedBackup(t *testing.T, base string, build string, count int, created time.Time) {
+	t.Helper()
+	for k := 0; k < count; k++ {
+		path := fmt.Sprintf("%s.%d", base, k)
+		err := os.WriteFile(path, []byte("archive"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := backupMeta{
+			Version: metaVersion,
+			Created: created,
+			Shard:   &metaShard{Build: build, Index: k, Count: count},
+		}
+		err = writeMetaFile(path+metaSuffix, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFindStoredBackupsGroupsShards(t *testing.T) {
+	dir := t.TempDir()
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	writeShardedBackup(t, filepath.Join(dir, "b1.tgz"), "one", 3, created)
+	writeShardedBackup(t, filepath.Join(dir, "b2.tgz"), "two", 3, created.Add(24*time.Hour))
+
+	backups, err := findStoredBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("found %d backups, want 2", len(backups))
+	}
+	for i, want := range []string{"b1.tgz", "b2.tgz"} {
+		b := backups[i]
+		if b.path != filepath.Join(dir, want) {
+			t.Errorf("backup %d is %s, want %s", i, b.path, want)
+		}
+		if len(b.files) != 3 {
+			t.Errorf("backup %s has %d files, want 3", b.path, len(b.files))
+		}
+	}
+}
+
+func TestPruneRemovesWholeShardedBackups(t *testing.T) {
+	dir := t.TempDir()
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	writeShardedBackup(t, filepath.Join(dir, "b1.tgz"), "one", 3, created)
+	writeShardedBackup(t, filepath.Join(dir, "b2.tgz"), "two", 3, created.Add(24*time.Hour))
+
+	err := prune([]string{"--keep-last", "1", "--grace", "0", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k < 3; k++ {
+		old := filepath.Join(dir, fmt.Sprintf("b1.tgz.%d", k))
+		if _, err := os.Stat(old); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed", old)
+		}
+		kept := filepath.Join(dir, fmt.Sprintf("b2.tgz.%d", k))
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("%s was removed: %s", kept, err)
+		}
+		if _, err := os.Stat(kept + metaSuffix); err != nil {
+			t.Errorf("%s was removed: %s", kept+metaSuffix, err)
+		}
+	}
+}
+
+func TestParseBackupName(t *testing.T) {
+	tests := []struct {
+		name, profile string
+		created       time.Time
+	}{
+		{"home-2024-05-01T120000.tgz", "home-*.tgz", time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)},
+		{"home-20240501-1230.tgz", "home-*.tgz", time.Date(2024, 5, 1, 12, 30, 0, 0, time.Local)},
+		{"etc_2024-05-01_12-30-15.tar.gz", "etc_*.tar.gz", time.Date(2024, 5, 1, 12, 30, 15, 0, time.Local)},
+		{"2024-05-01.tgz", "*.tgz", time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)},
+	}
+	for _, test := range tests {
+		profile, created, ok := parseBackupName(test.name)
+		if !ok || profile != test.profile || !created.Equal(test.created) {
+			t.Errorf("%s: got %q, %s, %t; want %q, %s", test.name, profile, created, ok, test.profile, test.created)
+		}
+	}
+	for _, name := range []string{"home.tgz", "home-2024-13-01.tgz", "build-120240501.tgz"} {
+		if _, _, ok := parseBackupName(name); ok {
+			t.Errorf("%s: found a date in it", name)
+		}
+	}
+}
+
+func TestPruneNamedBackupsPerProfile(t *testing.T) {
+	dir := t.TempDir()
+	gzipped := []byte{0x1f, 0x8b, 8, 0}
+	for _, name := range []string{
+		"home-2024-05-01T120000.tgz",
+		"home-2024-05-02T120000.tgz",
+		"home-2024-05-03T120000.tgz",
+		"etc-2024-04-01T120000.tgz",
+		"etc-2024-04-02T120000.tgz",
+		// not backups
+		"notes-2024-04-01.txt",
+		"home.tgz",
+	} {
+		data := gzipped
+		if filepath.Ext(name) == ".txt" {
+			data = []byte("text")
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := prune([]string{"--keep-last", "1", "--grace", "0", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"home-2024-05-01T120000.tgz": false,
+		"home-2024-05-02T120000.tgz": false,
+		"home-2024-05-03T120000.tgz": true,
+		"etc-2024-04-01T120000.tgz":  false,
+		"etc-2024-04-02T120000.tgz":  true,
+		"notes-2024-04-01.txt":       true,
+		"home.tgz":                   true,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists != want {
+			t.Errorf("%s: exists is %t, want %t", name, exists, want)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Backups can be encrypted to X25519 public keys instead of a password, so
+// the machine making them never holds what's needed to read them.  Keys are
+// Bech32 strings: public keys start with "backupkey1", and identity files
+// hold secret keys starting with "BACKUP-SECRET-KEY-1".  This is backup's own
+// format, not age's, and age can't read these keys or the backups.
+//
+// A random file key seals the chunks, and is wrapped once per recipient: an
+// ephemeral key pair is agreed with the recipient's key, and HKDF-SHA256 of
+// the shared secret, salted with both public keys, seals the file key.  In
+// the stream header, the key derivation byte is kdfRecipients and is followed
+// by:
+//
+//	recipient count (1) | per recipient: ephemeral public key (32) |
+//	                                     sealed file key (48)
+const (
+	recipientPrefix = "backupkey"
+	identityPrefix  = "BACKUP-SECRET-KEY-"
+	stanzaSize      = 32 + 32 + 16
+	// maxRecipients is what fits in the header's count
+	maxRecipients = 255
+	wrapLabel     = "backup/x25519"
+)
+
+// identities are the secret keys every command decrypts with, in the order
+// they were given
+var identities []*ecdh.PrivateKey
+
+// parseRecipient decodes a "backupkey1..." public key
+func parseRecipient(s string) (*ecdh.PublicKey, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if hrp != recipientPrefix {
+		return nil, fmt.Errorf("expected a public key starting with %s1", recipientPrefix)
+	}
+	return ecdh.X25519().NewPublicKey(data)
+}
+
+// readIdentities reads the secret keys in an identity file, one per line.
+// Blank lines and lines starting with # are ignored.
+func readIdentities(path string) ([]*ecdh.PrivateKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys []*ecdh.PrivateKey
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hrp, data, err := bech32Decode(line)
+		if err == nil && hrp != strings.ToLower(identityPrefix) {
+			err = fmt.Errorf("expected a secret key starting with %s1", identityPrefix)
+		}
+		var key *ecdh.PrivateKey
+		if err == nil {
+			key, err = ecdh.X25519().NewPrivateKey(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err.Error())
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no secret keys", path)
+	}
+	return keys, nil
+}
+
+// newRecipientKey makes a random file key and wraps it for each of
+// recipients
+func newRecipientKey(recipients []*ecdh.PublicKey) (*archiveKey, error) {
+	fileKey := make([]byte, 32)
+	_, err := rand.Read(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	fields := []byte{byte(len(recipients))}
+	for _, recipient := range recipients {
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ephemeral.ECDH(recipient)
+		if err != nil {
+			return nil, err
+		}
+		wrap, err := wrappingKey(shared, ephemeral.PublicKey(), recipient)
+		if err != nil {
+			return nil, err
+		}
+		// each wrapping key is used once, so the nonce can be fixed
+		fields = append(fields, ephemeral.PublicKey().Bytes()...)
+		fields = wrap.Seal(fields, make([]byte, wrap.NonceSize()), fileKey, nil)
+	}
+
+	aead, err := newChunkCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveKey{kdf: kdfParams{id: kdfRecipients}, fields: fields, aead: aead}, nil
+}
+
+// unwrapFileKey finds a stanza one of identities can open and returns the
+// file key in it
+func unwrapFileKey(stanzas [][]byte, identities []*ecdh.PrivateKey) ([]byte, error) {
+	if len(identities) == 0 {
+		return nil, errors.New("the backup is encrypted to public keys, give a secret key with --identity")
+	}
+	for _, stanza := range stanzas {
+		ephemeral, err := ecdh.X25519().NewPublicKey(stanza[:32])
+		if err != nil {
+			continue
+		}
+		for _, identity := range identities {
+			shared, err := identity.ECDH(ephemeral)
+			if err != nil {
+				continue
+			}
+			wrap, err := wrappingKey(shared, ephemeral, identity.PublicKey())
+			if err != nil {
+				return nil, err
+			}
+			fileKey, err := wrap.Open(nil, make([]byte, wrap.NonceSize()), stanza[32:], nil)
+			if err == nil {
+				return fileKey, nil
+			}
+		}
+	}
+	return nil, errors.New("none of the given secret keys can decrypt the backup")
+}
+
+// wrappingKey derives the key that seals the file key for one recipient
+func wrappingKey(shared []byte, ephemeral, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	salt := append(ephemeral.Bytes(), recipient.Bytes()...)
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(wrapLabel)), key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func keygen(args []string) error {
+	var outPath string
+	signing := false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup keygen [--help] [--sign] [-o FILE]
+
+Makes a key pair for 'backup build --recipient'.  The identity file, holding
+the secret key, is written to FILE or standard out, and the public key is
+printed to standard error.  Keep the identity file away from the machine being
+backed up, and give it to restore with --identity.  The keys and the backups
+encrypted to them are backup's own format, not age's: age and age-keygen can't
+read or use them.
+
+With --sign, makes a key pair for 'backup sign' instead.  That secret key stays
+on the machine being backed up, and the public key is given to verify-sig.
+
+Options:
+	-h, --help      this help message
+	-o, --output    where to write the identity file, which mustn't exist
+	--sign          make a signing key pair`)
+			return nil
+
+		case "--sign":
+			signing = true
+
+		case "-o", "--output":
+			outPath = tryGetArg(args, i+1)
+			if outPath == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			i++
+		default:
+			return exitError{
+				msg:  fmt.Sprintf("Unexpected argument '%s'", args[i]),
+				code: 1,
+			}
+		}
+	}
+
+	var public, secret string
+	if signing {
+		publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		public = encodeVerifyKey(publicKey)
+		secret = strings.ToUpper(bech32Encode(strings.ToLower(signingKeyPrefix), key.Seed()))
+	} else {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		public = bech32Encode(recipientPrefix, key.PublicKey().Bytes())
+		secret = strings.ToUpper(bech32Encode(strings.ToLower(identityPrefix), key.Bytes()))
+	}
+	identity := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), public, secret)
+
+	out := os.Stdout
+	var err error
+	if outPath != "" {
+		out, err = os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("Unable to create identity file: %s", err.Error())
+		}
+	}
+	_, err = out.WriteString(identity)
+	if outPath != "" {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write identity file: %s", err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "Public key: %s\n", public)
+	return nil
+}
+
+// bech32Charset maps 5-bit groups to characters, as in BIP 173
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	expanded := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	return expanded
+}
+
+// convertBits regroups data from groups of from bits into groups of to bits
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var acc uint32
+	var bits uint
+	var out []byte
+	maxv := uint32(1)<<to - 1
+	for _, b := range data {
+		if uint32(b)>>from != 0 {
+			return nil, errors.New("invalid data")
+		}
+		acc = acc<<from | uint32(b)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, errors.New("invalid padding")
+	}
+	return out, nil
+}
+
+// bech32Encode encodes data with the lowercase human-readable part hrp
+func bech32Encode(hrp string, data []byte) string {
+	values, _ := convertBits(data, 8, 5, true)
+	mod := bech32Polymod(append(append(bech32HRPExpand(hrp), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+	var s strings.Builder
+	s.WriteString(hrp)
+	s.WriteByte('1')
+	for _, v := range values {
+		s.WriteByte(bech32Charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		s.WriteByte(bech32Charset[(mod>>(5*(5-i)))&31])
+	}
+	return s.String()
+}
+
+// bech32Decode decodes s, returning its lowercase human-readable part and
+// data.  Unlike BIP 173, there's no length limit.
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case in key")
+	}
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, errors.New("malformed key")
+	}
+	hrp := s[:sep]
+	var values []byte
+	for i := sep + 1; i < len(s); i++ {
+		v := strings.IndexByte(bech32Charset, s[i])
+		if v < 0 {
+			return "", nil, fmt.Errorf("invalid character '%c' in key", s[i])
+		}
+		values = append(values, byte(v))
+	}
+	if bech32Polymod(append(bech32HRPExpand(hrp), values...)) != 1 {
+		return "", nil, errors.New("bad checksum, the key may be mistyped")
+	}
+	data, err := convertBits(values[:len(values)-6], 5, 8, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return hrp, data, nil
+}
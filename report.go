@@ -0,0 +1,303 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"html/template"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// reportTop is how many rows the largest-of tables in a report show
+const reportTop = 25
+
+// backupEntry is what a report needs to know about one entry of a backup
+type backupEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// dirGrowth is the change in size of a directory, including its
+// subdirectories, between two backups
+type dirGrowth struct {
+	Dir    string
+	Before int64
+	After  int64
+	Growth int64
+}
+
+type reportData struct {
+	Backup       string
+	Previous     string
+	Generated    time.Time
+	Files        int
+	Bytes        int64
+	Largest      []backupEntry
+	Growth       []dirGrowth
+	Added        []backupEntry
+	Removed      []backupEntry
+	ReadProblems []string
+}
+
+func report(args []string) error {
+	var htmlPath string
+	var backupPaths []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup report [--help] --html OUTPUT [--password-file FILE] [--use-keyring]
+	              [--identity FILE] <backup_file> [previous_backup_file]
+
+Writes an HTML report describing a backup: its largest files and, when a
+previous backup is given, which directories grew the most and which paths
+were added or removed since then.
+
+Options:
+	-h, --help      this help message
+	--html          where to write the report
+	--password-file FILE
+	                read the password of encrypted backups from the first line
+	                of FILE instead of asking for it
+	--use-keyring   read the password from the system keyring, where build
+	                --use-keyring stores it
+	--identity FILE
+	                decrypt backups encrypted with --recipient using the
+	                secret keys in FILE, made by 'backup keygen'; can be used
+	                more than once`)
+			return nil
+
+		case "--html":
+			htmlPath = tryGetArg(args, i+1)
+			if htmlPath == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			i++
+		case "--use-keyring":
+			passwords.keyring = true
+		case "--password-file":
+			s := tryGetArg(args, i+1)
+			if s == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			passwords.file = s
+			i++
+		case "--identity":
+			keys, err := readIdentities(tryGetArg(args, i+1))
+			if err != nil {
+				return exitError{
+					msg:  fmt.Sprintf("Unable to read the identity file after '%s': %s", args[i], err.Error()),
+					code: 1,
+				}
+			}
+			identities = append(identities, keys...)
+			i++
+		default:
+			backupPaths = append(backupPaths, args[i])
+		}
+	}
+	if htmlPath == "" || len(backupPaths) == 0 || len(backupPaths) > 2 {
+		return exitError{
+			msg:  "Expected --html, a backup file, and optionally a previous backup file",
+			code: 1,
+		}
+	}
+
+	data := reportData{
+		Backup:    backupPaths[0],
+		Generated: time.Now(),
+	}
+	current, err := listBackup(backupPaths[0])
+	if err != nil {
+		data.ReadProblems = append(data.ReadProblems, err.Error())
+	}
+	for _, entry := range current {
+		data.Files++
+		data.Bytes += entry.Size
+		data.Largest = append(data.Largest, entry)
+	}
+	sortBySize(data.Largest)
+	if len(data.Largest) > reportTop {
+		data.Largest = data.Largest[:reportTop]
+	}
+
+	if len(backupPaths) == 2 {
+		data.Previous = backupPaths[1]
+		previous, err := listBackup(backupPaths[1])
+		if err != nil {
+			data.ReadProblems = append(data.ReadProblems, err.Error())
+		}
+		data.Added, data.Removed = diffEntries(previous, current)
+		data.Growth = dirGrowths(previous, current)
+	}
+
+	file, err := os.Create(htmlPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return reportTemplate.Execute(file, data)
+}
+
+// listBackup reads the entries of a backup, keyed by name.  On error, the
+// entries read before the problem are returned along with it.
+func listBackup(backupPath string) (map[string]backupEntry, error) {
+	entries := map[string]backupEntry{}
+	reader, err := openBackup(backupPath)
+	if err != nil {
+		return entries, fmt.Errorf("Unable to open backup '%s': %s", backupPath, err.Error())
+	}
+	defer reader.Close()
+
+	err = reader.eachEntry(func(header *tar.Header) error {
+		entries[header.Name] = backupEntry{
+			Name:    header.Name,
+			Size:    header.Size,
+			ModTime: header.ModTime,
+		}
+		return nil
+	})
+	if err != nil {
+		return entries, fmt.Errorf("Error reading backup '%s': %s", backupPath, err.Error())
+	}
+	return entries, nil
+}
+
+// diffEntries lists the entries that were added and removed going from
+// before to after, largest first
+func diffEntries(before, after map[string]backupEntry) (added, removed []backupEntry) {
+	for name, entry := range after {
+		if _, ok := before[name]; !ok {
+			added = append(added, entry)
+		}
+	}
+	for name, entry := range before {
+		if _, ok := after[name]; !ok {
+			removed = append(removed, entry)
+		}
+	}
+	sortBySize(added)
+	sortBySize(removed)
+	return added, removed
+}
+
+// dirGrowths totals each directory (including subdirectories) in both backups
+// and returns the ones that grew the most
+func dirGrowths(before, after map[string]backupEntry) []dirGrowth {
+	dirs := map[string]*dirGrowth{}
+	total := func(entries map[string]backupEntry, add func(g *dirGrowth, size int64)) {
+		for name, entry := range entries {
+			for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+				g := dirs[dir]
+				if g == nil {
+					g = &dirGrowth{Dir: dir}
+					dirs[dir] = g
+				}
+				add(g, entry.Size)
+			}
+		}
+	}
+	total(before, func(g *dirGrowth, size int64) { g.Before += size })
+	total(after, func(g *dirGrowth, size int64) { g.After += size })
+
+	var growths []dirGrowth
+	for _, g := range dirs {
+		g.Growth = g.After - g.Before
+		if g.Growth > 0 {
+			growths = append(growths, *g)
+		}
+	}
+	sort.Slice(growths, func(i, j int) bool {
+		if growths[i].Growth != growths[j].Growth {
+			return growths[i].Growth > growths[j].Growth
+		}
+		return growths[i].Dir < growths[j].Dir
+	})
+	if len(growths) > reportTop {
+		growths = growths[:reportTop]
+	}
+	return growths
+}
+
+// sortBySize sorts entries largest first, then by name
+func sortBySize(entries []backupEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Size != entries[j].Size {
+			return entries[i].Size > entries[j].Size
+		}
+		return entries[i].Name < entries[j].Name
+	})
+}
+
+// humanSize formats a byte count using binary units
+func humanSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 && n > -1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f := float64(n)
+	i := -1
+	for (f >= 1024 || f <= -1024) && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", f, units[i])
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"size": humanSize,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Backup report: {{.Backup}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 0.2em 1em; text-align: left; border-bottom: 1px solid #ddd; }
+td.num { text-align: right; }
+.problem { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Backup report</h1>
+<p>{{.Backup}}: {{.Files}} files, {{size .Bytes}}{{if .Previous}}, compared against {{.Previous}}{{end}}.
+Generated {{.Generated.Format "2006-01-02 15:04:05"}}.</p>
+{{range .ReadProblems}}<p class="problem">{{.}}</p>
+{{end}}
+<h2>Largest files</h2>
+<table>
+<tr><th>Path</th><th>Size</th><th>Modified</th></tr>
+{{range .Largest}}<tr><td>{{.Name}}</td><td class="num">{{size .Size}}</td><td>{{.ModTime.Format "2006-01-02"}}</td></tr>
+{{end}}</table>
+{{if .Previous}}
+<h2>Biggest growth</h2>
+<table>
+<tr><th>Directory</th><th>Before</th><th>After</th><th>Growth</th></tr>
+{{range .Growth}}<tr><td>{{.Dir}}</td><td class="num">{{size .Before}}</td><td class="num">{{size .After}}</td><td class="num">+{{size .Growth}}</td></tr>
+{{end}}</table>
+
+<h2>New paths ({{len .Added}})</h2>
+<table>
+<tr><th>Path</th><th>Size</th></tr>
+{{range .Added}}<tr><td>{{.Name}}</td><td class="num">{{size .Size}}</td></tr>
+{{end}}</table>
+
+<h2>Removed paths ({{len .Removed}})</h2>
+<table>
+<tr><th>Path</th><th>Size</th></tr>
+{{range .Removed}}<tr><td>{{.Name}}</td><td class="num">{{size .Size}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
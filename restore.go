@@ -0,0 +1,801 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// restoreOptions collects everything the restore command was asked to do
+type restoreOptions struct {
+	backupPath string
+	// target is the directory to restore into instead of the home directory
+	target string
+	// patterns pick the entries to restore, all of them if empty
+	patterns []restorePattern
+	// conflict decides what happens to files that are already there
+	conflict conflictPolicy
+	// conflictSet is true once a conflict option has been given
+	conflictSet bool
+	// caseCollisions decides what happens to entries whose names differ
+	// only in case from an earlier one
+	caseCollisions collisionPolicy
+	// dryRun lists what would be restored without restoring it
+	dryRun bool
+	// transforms rewrite entry names before they're restored
+	transforms []nameTransform
+	// owners sets who owns restored files, nil to leave them owned by
+	// whoever runs the restore
+	owners *owners
+	// ownership options, which only take effect when running as root
+	numericOwner bool
+	uidMap       map[int]int
+	gidMap       map[int]int
+}
+
+// conflictPolicy is what to do when something already exists where an entry
+// is restored to
+type conflictPolicy int
+
+const (
+	// overwrite replaces what's there
+	overwrite conflictPolicy = iota
+	skipExisting
+	// keepNewer only replaces what's there if the backup's copy is newer
+	keepNewer
+	// renameExisting moves what's there aside to a numbered name
+	renameExisting
+	// updateChanged only replaces what differs from the backup's copy
+	updateChanged
+)
+
+// collisionPolicy is what to do with an entry whose name differs only in
+// case from an earlier one, which it would replace on a case-insensitive
+// filesystem
+type collisionPolicy int
+
+const (
+	// collisionWarn restores it anyway
+	collisionWarn collisionPolicy = iota
+	// collisionSkip keeps the earlier entry
+	collisionSkip
+	// collisionRename restores it under a numbered name
+	collisionRename
+)
+
+// restorePattern is a pattern given on the command line to pick entries
+type restorePattern struct {
+	text    string
+	re      *regexp.Regexp
+	matched bool
+}
+
+func restore(args []string) error {
+	opts := restoreOptions{uidMap: map[int]int{}, gidMap: map[int]int{}}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup restore [--help] [--target DIR] [--dry-run] [--numeric-owner]
+	               [--map-user OLD:NEW] [--map-group OLD:NEW] [--transform RULE]
+	               [--overwrite|--skip-existing|--keep-newer|--rename-existing|
+	                --update] [--password-file FILE] [--use-keyring]
+	               [--identity FILE] [--case-collisions warn|skip|rename]
+	               <backup_file> [PATTERN...]
+
+Restores the files in the given backup into your home directory, where they
+were backed up from, or into another directory with --target.  Files,
+directories, symlinks, and hardlinks are recreated with the permissions and
+modification times they had.  What happens to files that already exist is up to
+the conflict options, and by default they're overwritten.  Entries that
+would end up outside the directory being restored into, through an absolute
+name, '..', or a symlink, are skipped.
+
+Given patterns, only the entries they match are restored, as in
+'backup restore backup.tgz Documents .config/nvim/*'.  Patterns are globs
+matched against the names in the backup; '**' also matches across
+directories, including none, as in 'Documents/**/*.odt'.  A pattern that
+matches a directory restores everything in it.
+
+Names can be rewritten before anything is restored with --transform, to fit a
+backup made with an older layout into a reorganized home.  A rule is either a
+sed-style substitution, 's|^old-dotfiles/|.config/|', where \1 refers to a
+group, $ is taken literally, and a trailing g replaces every match, or a
+prefix mapping, 'old-dotfiles=.config', which only matches whole directory
+names.  Rules are applied in the order they're given, and an entry whose name
+becomes empty is skipped.  Patterns are matched against the names before
+they're rewritten.
+
+When run as root, restored files are given the owner and group they had, by
+name if the name exists on this system and by the stored uid and gid
+otherwise.  Other users can't give files away, so their restored files are
+their own.
+
+Backups that were concatenated with cat are restored in a single pass.  A
+backup built with --shards is restored from all of its shards, in order, when
+given the output it was built to, without the shards' .0 to .N-1 suffixes.
+Encrypted backups ask for their password, and the restore stops with an error
+at the first sign that the backup was changed or cut short.
+
+Options:
+	-h, --help      this help message
+	--overwrite     replace existing files, the default
+	--skip-existing leave existing files alone
+	--keep-newer    only replace existing files that were modified before the
+	                backup's copy
+	--rename-existing
+	                move existing files aside to NAME.~N~, as 'cp --backup'
+	                does, before restoring
+	--update        only replace existing files that differ from the backup's
+	                copy: files of the same size and modification time are
+	                left alone, and files of the same size but another time
+	                are compared byte for byte and only have their times and
+	                permissions fixed if they match; use it to restore onto a
+	                mostly intact home quickly
+	--case-collisions POLICY
+	                what to do with entries whose names differ only in case
+	                from an earlier one, which they'd replace on a
+	                case-insensitive filesystem like those of macOS and
+	                Windows: 'warn', the default, restores them anyway,
+	                'skip' keeps the earlier one, and 'rename' restores them
+	                as NAME.~N~; directories are always merged
+	--dry-run       list what would be created, overwritten, merged, renamed,
+	                or skipped, with sizes, without changing anything
+	--numeric-owner always use the uid and gid stored in the backup, ignoring
+	                the owner and group names
+	--map-user OLD:NEW
+	                give files owned by uid OLD to uid NEW instead, after names
+	                are looked up; can be used more than once
+	--map-group OLD:NEW
+	                the same for gids
+	--transform RULE
+	                rewrite entry names with RULE; can be used more than once
+	--target DIR    the directory to restore into instead of your home
+	                directory, created if it doesn't exist; use it to look
+	                through a backup or move it to another machine without
+	                touching your live files
+	--password-file FILE
+	                read the password of an encrypted backup from the first
+	                line of FILE instead of asking for it
+	--use-keyring   read the password from the system keyring, where build
+	                --use-keyring stores it
+	--identity FILE
+	                decrypt backups encrypted with --recipient using the
+	                secret keys in FILE, made by 'backup keygen'; can be used
+	                more than once`)
+			return nil
+
+		case "--target":
+			s := tryGetArg(args, i+1)
+			if s == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			opts.target = s
+			i++
+		case "--dry-run":
+			opts.dryRun = true
+		case "--case-collisions":
+			s := tryGetArg(args, i+1)
+			switch s {
+			case "warn":
+				opts.caseCollisions = collisionWarn
+			case "skip":
+				opts.caseCollisions = collisionSkip
+			case "rename":
+				opts.caseCollisions = collisionRename
+			case "":
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			default:
+				return exitError{
+					msg:  fmt.Sprintf("Unknown case collision policy '%s'", s),
+					code: 1,
+				}
+			}
+			i++
+		case "--identity":
+			keys, err := readIdentities(tryGetArg(args, i+1))
+			if err != nil {
+				return exitError{
+					msg:  fmt.Sprintf("Unable to read the identity file after '%s': %s", args[i], err.Error()),
+					code: 1,
+				}
+			}
+			identities = append(identities, keys...)
+			i++
+		case "--use-keyring":
+			passwords.keyring = true
+		case "--password-file":
+			s := tryGetArg(args, i+1)
+			if s == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			passwords.file = s
+			i++
+		case "--transform":
+			t, err := parseTransform(tryGetArg(args, i+1))
+			if err != nil {
+				return exitError{
+					msg:  fmt.Sprintf("Bad rule after '%s': %s", args[i], err.Error()),
+					code: 1,
+				}
+			}
+			opts.transforms = append(opts.transforms, t)
+			i++
+		case "--numeric-owner":
+			opts.numericOwner = true
+		case "--map-user", "--map-group":
+			mapping := opts.uidMap
+			if args[i] == "--map-group" {
+				mapping = opts.gidMap
+			}
+			err := parseIDMapping(tryGetArg(args, i+1), mapping)
+			if err != nil {
+				return exitError{
+					msg:  fmt.Sprintf("Bad mapping after '%s': %s", args[i], err.Error()),
+					code: 1,
+				}
+			}
+			i++
+		case "--overwrite", "--skip-existing", "--keep-newer", "--rename-existing", "--update":
+			if opts.conflictSet {
+				return exitError{
+					msg:  "Only one of --overwrite, --skip-existing, --keep-newer, --rename-existing, and --update can be used",
+					code: 1,
+				}
+			}
+			opts.conflictSet = true
+			switch args[i] {
+			case "--overwrite":
+				opts.conflict = overwrite
+			case "--skip-existing":
+				opts.conflict = skipExisting
+			case "--keep-newer":
+				opts.conflict = keepNewer
+			case "--update":
+				opts.conflict = updateChanged
+			default:
+				opts.conflict = renameExisting
+			}
+		default:
+			if opts.backupPath == "" {
+				opts.backupPath = args[i]
+				continue
+			}
+			re, err := compileRestorePattern(args[i])
+			if err != nil {
+				return exitError{
+					msg:  fmt.Sprintf("Bad pattern '%s': %s", args[i], err.Error()),
+					code: 1,
+				}
+			}
+			opts.patterns = append(opts.patterns, restorePattern{text: args[i], re: re})
+		}
+	}
+	if opts.backupPath == "" {
+		return exitError{
+			msg:  "Expected a backup file to restore from",
+			code: 1,
+		}
+	}
+
+	if os.Geteuid() == 0 {
+		opts.owners = newOwners()
+		opts.owners.numeric = opts.numericOwner
+		opts.owners.uidMap = opts.uidMap
+		opts.owners.gidMap = opts.gidMap
+	}
+	return runRestore(opts)
+}
+
+// restoredDir is a directory whose metadata is applied once everything in it
+// has been restored, since restoring its contents changes its modification
+// time and it may not be writable
+type restoredDir struct {
+	path   string
+	header *tar.Header
+}
+
+func runRestore(opts restoreOptions) error {
+	dest := opts.target
+	if dest != "" && !opts.dryRun {
+		err := os.MkdirAll(dest, 0777)
+		if err != nil {
+			return exitError{
+				msg:  fmt.Sprintf("Unable to create the target directory '%s': %s", dest, err.Error()),
+				code: 2,
+			}
+		}
+	} else if dest == "" {
+		var err error
+		dest, err = homeDir("")
+		if err != nil {
+			return err
+		}
+	}
+	// symlinks are resolved so containment checks compare real paths
+	root, err := filepath.EvalSymlinks(dest)
+	if os.IsNotExist(err) && opts.dryRun {
+		// a dry run doesn't create the target, and everything in it is new
+		root, err = filepath.Abs(dest)
+	}
+	if err != nil {
+		return exitError{
+			msg:  fmt.Sprintf("Unable to restore into '%s': %s", dest, err.Error()),
+			code: 2,
+		}
+	}
+
+	backup, err := openBackup(opts.backupPath)
+	if err != nil {
+		return exitError{
+			msg:  fmt.Sprintf("Unable to open backup '%s': %s", opts.backupPath, err.Error()),
+			code: 2,
+		}
+	}
+	defer backup.Close()
+
+	var dirs []restoredDir
+	restored, skipped, failed := 0, 0, 0
+	names := caseNames{}
+	// renamed maps the names of entries restored under another name to it,
+	// for hardlinks to them
+	renamed := map[string]string{}
+	err = backup.eachEntry(func(header *tar.Header) error {
+		if !opts.selects(header.Name) {
+			return nil
+		}
+		if len(opts.transforms) > 0 {
+			header.Name = transformName(opts.transforms, header.Name)
+			if header.Typeflag == tar.TypeLink {
+				header.Linkname = transformName(opts.transforms, header.Linkname)
+			}
+			if header.Name == "" {
+				return nil
+			}
+		}
+		if header.Typeflag == tar.TypeLink && renamed[path.Clean(header.Linkname)] != "" {
+			header.Linkname = renamed[path.Clean(header.Linkname)]
+		}
+		if first := names.collision(header.Name); first != "" && header.Typeflag != tar.TypeDir {
+			switch opts.caseCollisions {
+			case collisionSkip:
+				fmt.Fprintf(os.Stderr, "Skipping '%s', which differs only in case from '%s'\n", header.Name, first)
+				return nil
+			case collisionRename:
+				name := names.free(header.Name)
+				fmt.Fprintf(os.Stderr, "Restoring '%s' as '%s', since it differs only in case from '%s'\n", header.Name, name, first)
+				renamed[path.Clean(header.Name)] = name
+				header.Name = name
+			default:
+				fmt.Fprintf(os.Stderr, "Warning: '%s' differs only in case from '%s', and replaces it on a case-insensitive filesystem\n", header.Name, first)
+			}
+		}
+		target, err := restoreTarget(root, header.Name)
+		var action restoreAction
+		if err == nil {
+			action, err = planRestore(target, header, opts.conflict)
+		}
+		var contents io.Reader = backup
+		if err == nil && action == actionCompare {
+			var existing *os.File
+			existing, err = os.Open(target)
+			if err == nil {
+				defer existing.Close()
+				action, contents, err = compareContents(backup, existing)
+			}
+			if err == nil && action == actionSkip && !opts.dryRun {
+				// unchanged, but its times or permissions may not be
+				err = setMetadata(target, header, opts.owners)
+			}
+		}
+		if err == nil && opts.dryRun {
+			fmt.Printf("%-9s %s (%s)\n", action, target, humanSize(header.Size))
+		}
+		if err == nil && action == actionSkip {
+			skipped++
+			return nil
+		}
+		if err == nil && opts.dryRun {
+			restored++
+			return nil
+		}
+		if err == nil && action == actionRename {
+			err = moveAside(target)
+		}
+		if err == nil {
+			err = restoreEntry(contents, header, root, target, opts.owners)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to restore '%s': %s\n", header.Name, err.Error())
+			failed++
+			return nil
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, restoredDir{path: target, header: header})
+		}
+		restored++
+		return nil
+	})
+
+	// children come after their parents in the backup, so going backwards
+	// finishes each directory after everything inside it
+	for i := len(dirs) - 1; i >= 0 && !opts.dryRun; i-- {
+		dir := dirs[i]
+		// a later entry may have put something else in its place
+		err := checkRealDir(root, dir.path)
+		if err == nil {
+			err = setMetadata(dir.path, dir.header, opts.owners)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to set the permissions and times of '%s': %s\n", dir.path, err.Error())
+		}
+	}
+
+	if err != nil {
+		return exitError{
+			msg:  fmt.Sprintf("Unable to read backup '%s' after restoring %d entries: %s", opts.backupPath, restored, err.Error()),
+			code: 2,
+		}
+	}
+	verb := "Restored"
+	if opts.dryRun {
+		verb = "Would restore"
+	}
+	fmt.Fprintf(os.Stderr, "%s %d entries to '%s'", verb, restored, dest)
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, ", leaving %d existing ones alone", skipped)
+	}
+	fmt.Fprintln(os.Stderr)
+	unmatched := 0
+	for _, pattern := range opts.patterns {
+		if !pattern.matched {
+			fmt.Fprintf(os.Stderr, "Warning: '%s' didn't match anything in the backup\n", pattern.text)
+			unmatched++
+		}
+	}
+	if failed > 0 {
+		return exitError{
+			msg:  fmt.Sprintf("Unable to restore %d entries", failed),
+			code: 2,
+		}
+	}
+	if unmatched > 0 {
+		return exitError{
+			msg:  fmt.Sprintf("%d patterns didn't match anything", unmatched),
+			code: 1,
+		}
+	}
+	return nil
+}
+
+// compileRestorePattern turns a restore pattern into a regular expression.
+// It's a glob like the ones in list files, except that '**' matches any
+// number of directories.
+func compileRestorePattern(pattern string) (*regexp.Regexp, error) {
+	parts := strings.Split(strings.TrimSuffix(path.Clean(pattern), "/"), "**")
+	for i, part := range parts {
+		if _, err := filepath.Match(part, ""); err != nil {
+			return nil, err
+		}
+		parts[i] = globToRegexp(part)
+	}
+	// '**' between slashes can also match no directories at all
+	expr := strings.Join(parts, "\x00")
+	expr = strings.ReplaceAll(expr, "/\x00/", "/(?:.*/)?")
+	if strings.HasPrefix(expr, "\x00/") {
+		expr = "(?:.*/)?" + expr[2:]
+	}
+	expr = strings.ReplaceAll(expr, "\x00", ".*")
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// selects reports whether the entry called name is to be restored, which it
+// is if it or one of its parent directories matches a pattern
+func (opts *restoreOptions) selects(name string) bool {
+	if len(opts.patterns) == 0 {
+		return true
+	}
+	name = strings.TrimSuffix(path.Clean(name), "/")
+	selected := false
+	for i := range opts.patterns {
+		pattern := &opts.patterns[i]
+		for p := name; p != "." && p != "/"; p = path.Dir(p) {
+			if pattern.re.MatchString(p) {
+				pattern.matched = true
+				selected = true
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// restoreTarget returns where the entry called name is restored to under
+// root, refusing names that lead outside of it
+func restoreTarget(root string, name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("the name leads outside of '%s'", root)
+	}
+	target := filepath.Join(root, filepath.FromSlash(clean))
+
+	// a symlink restored earlier could point the parent directory elsewhere,
+	// so the deepest of its ancestors that exists has to be inside root
+	for dir := filepath.Dir(target); ; dir = filepath.Dir(dir) {
+		real, err := filepath.EvalSymlinks(dir)
+		if os.IsNotExist(err) && dir == root {
+			// only in a dry run, nothing's there to lead anywhere
+			return target, nil
+		} else if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(root, real)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", fmt.Errorf("a symlink leads its directory outside of '%s'", root)
+		}
+		return target, nil
+	}
+}
+
+// checkRealDir makes sure target is a directory inside root, not a symlink
+// or a directory reached through one, before its metadata is changed
+func checkRealDir(root string, target string) error {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is no longer a directory", target)
+	}
+	real, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("'%s' leads outside of '%s'", target, root)
+	}
+	return nil
+}
+
+// restoreAction is what restoring an entry does to the target
+type restoreAction string
+
+const (
+	actionCreate    restoreAction = "create"
+	actionOverwrite restoreAction = "overwrite"
+	// actionMerge restores a directory into an existing one
+	actionMerge restoreAction = "merge"
+	actionSkip  restoreAction = "skip"
+	// actionRename moves what's there aside before restoring
+	actionRename restoreAction = "rename"
+	// actionCompare compares the contents of what's there to decide between
+	// skipping and overwriting
+	actionCompare restoreAction = "compare"
+)
+
+// planRestore decides what restoring header at target does, according to
+// policy, without changing anything.  A directory being restored over an
+// existing one is merged with it, only taking its permissions and times if
+// the policy would replace a file.
+func planRestore(target string, header *tar.Header, policy conflictPolicy) (restoreAction, error) {
+	existing, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return actionCreate, nil
+	} else if err != nil {
+		return "", err
+	}
+	merging := header.Typeflag == tar.TypeDir && existing.IsDir()
+
+	action := actionOverwrite
+	if merging {
+		action = actionMerge
+	}
+	switch policy {
+	case skipExisting:
+		return actionSkip, nil
+	case keepNewer:
+		if !header.ModTime.After(existing.ModTime()) {
+			return actionSkip, nil
+		}
+	case renameExisting:
+		if !merging {
+			return actionRename, nil
+		}
+	case updateChanged:
+		return planUpdate(target, existing, header, action)
+	}
+	return action, nil
+}
+
+// planUpdate decides whether the entry at target differs from header and
+// needs replacing with action.  Like rsync, a regular file of the same size
+// and modification time is taken to be unchanged without reading it.
+// Headers may only store whole seconds, so times are compared to the second.
+func planUpdate(target string, existing os.FileInfo, header *tar.Header, action restoreAction) (restoreAction, error) {
+	switch {
+	case header.Typeflag == tar.TypeSymlink && existing.Mode()&os.ModeSymlink != 0:
+		linkname, err := os.Readlink(target)
+		if err != nil {
+			return "", err
+		}
+		if linkname == header.Linkname {
+			return actionSkip, nil
+		}
+	case (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA) && existing.Mode().IsRegular():
+		if existing.Size() != header.Size {
+			break
+		}
+		if existing.ModTime().Unix() == header.ModTime.Unix() {
+			return actionSkip, nil
+		}
+		return actionCompare, nil
+	}
+	return action, nil
+}
+
+// compareContents reads the entry from r and compares it to the existing
+// file.  If they differ, the returned reader has the entry's full contents,
+// with the part that matched read back from the existing file, which stays
+// open while it's replaced.
+func compareContents(r io.Reader, existing *os.File) (restoreAction, io.Reader, error) {
+	entry := make([]byte, 64<<10)
+	current := make([]byte, len(entry))
+	var matched int64
+	for {
+		n, err := io.ReadFull(r, entry)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		} else if err != nil {
+			return "", nil, err
+		}
+		if n == 0 {
+			return actionSkip, nil, nil
+		}
+		m, _ := io.ReadFull(existing, current[:n])
+		if m != n || !bytes.Equal(entry[:n], current[:n]) {
+			rest := io.MultiReader(io.NewSectionReader(existing, 0, matched), bytes.NewReader(entry[:n]), r)
+			return actionOverwrite, rest, nil
+		}
+		matched += int64(n)
+	}
+}
+
+// moveAside renames target to the first free NAME.~N~
+func moveAside(target string) error {
+	for n := 1; ; n++ {
+		aside := fmt.Sprintf("%s.~%d~", target, n)
+		if _, err := os.Lstat(aside); os.IsNotExist(err) {
+			return os.Rename(target, aside)
+		}
+	}
+}
+
+// restoreEntry recreates the entry described by header at target, reading its
+// contents from r
+func restoreEntry(r io.Reader, header *tar.Header, root string, target string, owners *owners) error {
+	if header.Typeflag != tar.TypeDir {
+		err := os.MkdirAll(filepath.Dir(target), 0777)
+		if err != nil {
+			return err
+		}
+		// whatever is in the way is replaced, and removing it first means a
+		// symlink there is never followed
+		err = os.Remove(target)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		// anything but a directory in the way is replaced, so a symlink
+		// there never leads the directory elsewhere
+		existing, err := os.Lstat(target)
+		if err == nil && !existing.IsDir() {
+			err = os.Remove(target)
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(target, 0777)
+		if err != nil {
+			return err
+		}
+		err = checkRealDir(root, target)
+		if err != nil {
+			return err
+		}
+		// owner permissions are needed to restore what's inside, the
+		// directory's own mode is applied afterwards
+		return os.Chmod(target, 0700)
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, r)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		err := os.Symlink(header.Linkname, target)
+		if err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		source, err := restoreTarget(root, header.Linkname)
+		if err != nil {
+			return err
+		}
+		err = os.Link(source, target)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("entries of type '%c' aren't restored", header.Typeflag)
+	}
+	return setMetadata(target, header, owners)
+}
+
+// setMetadata applies the ownership, permissions, and times in header to the
+// entry at target.  Symlinks have no permissions of their own.  Ownership is
+// left alone if owners is nil.  Hardlinks are left alone too: they share the
+// inode of the entry they link to, which already has its metadata, and that
+// entry may be a symlink, which chmod and chtimes would follow.
+func setMetadata(target string, header *tar.Header, owners *owners) error {
+	if header.Typeflag == tar.TypeLink {
+		return nil
+	}
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	times := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(header.ModTime.UnixNano()),
+	}
+
+	if owners != nil {
+		// before the mode, since changing the owner clears setuid and setgid
+		uid, gid := owners.ids(header)
+		err := os.Lchown(target, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	if header.Typeflag == tar.TypeSymlink {
+		return unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW)
+	}
+	mode := header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	err := os.Chmod(target, mode)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(target, atime, header.ModTime)
+}
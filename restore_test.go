@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestBackup writes a backup holding headers, with contents for the
+// regular files
+func writeTestBackup(t *testing.T, path string, headers []*tar.Header, contents map[string]string) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	compressor := gzip.NewWriter(file)
+	archiver := tar.NewWriter(compressor)
+	for _, header := range headers {
+		data := contents[header.Name]
+		header.Size = int64(len(data))
+		if err := archiver.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archiver.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archiver.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressor.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreDirectoryOverSymlinkStaysInside(t *testing.T) {
+	tmp := t.TempDir()
+	outside := filepath.Join(tmp, "outside")
+	if err := os.Mkdir(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2023, 3, 4, 5, 6, 7, 0, time.UTC)
+	if err := os.Chtimes(outside, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	backupPath := filepath.Join(tmp, "evil.tgz")
+	writeTestBackup(t, backupPath, []*tar.Header{
+		{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777},
+		{Name: "evil/", Typeflag: tar.TypeDir, Mode: 0777, ModTime: time.Unix(0, 0)},
+	}, nil)
+
+	target := filepath.Join(tmp, "target")
+	err := runRestore(restoreOptions{backupPath: backupPath, target: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("outside directory's mode changed to %o", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("outside directory's modification time changed to %s", info.ModTime())
+	}
+	restored, err := os.Lstat(filepath.Join(target, "evil"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.IsDir() {
+		t.Errorf("restored 'evil' is %s, not a directory", restored.Mode().Type())
+	}
+}
+
+func TestRestoreHardlinkToSymlinkStaysInside(t *testing.T) {
+	tmp := t.TempDir()
+	outside := filepath.Join(tmp, "outside")
+	if err := os.WriteFile(outside, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2023, 3, 4, 5, 6, 7, 0, time.UTC)
+	if err := os.Chtimes(outside, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	backupPath := filepath.Join(tmp, "evil.tgz")
+	writeTestBackup(t, backupPath, []*tar.Header{
+		{Name: "s", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777},
+		{Name: "h", Typeflag: tar.TypeLink, Linkname: "s", Mode: 0777, ModTime: time.Unix(0, 0)},
+	}, nil)
+
+	target := filepath.Join(tmp, "target")
+	err := runRestore(restoreOptions{backupPath: backupPath, target: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("outside file's mode changed to %o", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("outside file's modification time changed to %s", info.ModTime())
+	}
+}
+
+func TestRestoreReadsEveryShard(t *testing.T) {
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source")
+	if err := os.Mkdir(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var selected selection
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%d", i)
+		path := filepath.Join(source, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		selected.files = append(selected.files, selectedFile{path: path, name: name})
+	}
+
+	// built the way runBuild writes shards
+	base := filepath.Join(tmp, "backup.tgz")
+	parts := partitionSelection(selected, 3)
+	opts := buildOptions{progress: newProgress(len(selected.files), sizeEstimate{})}
+	for k, part := range parts {
+		output := openOutputs(shardPaths([]string{base}, 3)[k])
+		result := writeArchive(output, part, &opts)
+		output.close()
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+	}
+
+	target := filepath.Join(tmp, "target")
+	err := runRestore(restoreOptions{backupPath: base, target: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range selected.files {
+		data, err := os.ReadFile(filepath.Join(target, file.name))
+		if err != nil {
+			t.Errorf("%s wasn't restored: %s", file.name, err)
+		} else if string(data) != file.name {
+			t.Errorf("%s was restored as %q", file.name, data)
+		}
+	}
+}
+
+func TestRestoreRefusesMissingShards(t *testing.T) {
+	tmp := t.TempDir()
+	base := filepath.Join(tmp, "backup.tgz")
+	for k := 0; k < 2; k++ {
+		path := fmt.Sprintf("%s.%d", base, k)
+		writeTestBackup(t, path, nil, nil)
+		meta := backupMeta{Version: metaVersion, Shard: &metaShard{Build: "b", Index: k, Count: 3}}
+		if err := writeMetaFile(path+metaSuffix, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := runRestore(restoreOptions{backupPath: base, target: filepath.Join(tmp, "target")})
+	if err == nil {
+		t.Fatal("restored a backup missing one of its shards")
+	}
+}
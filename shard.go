@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+)
+
+// shardPaths names the files each of n shards is written to: every output
+// path with the shard's index appended
+func shardPaths(outPaths []string, n int) [][]string {
+	paths := make([][]string, n)
+	for k := range paths {
+		for _, outPath := range outPaths {
+			paths[k] = append(paths[k], fmt.Sprintf("%s.%d", outPath, k))
+		}
+	}
+	return paths
+}
+
+// partitionSelection splits selected into n parts.  A file is assigned by the
+// hash of its name, so it stays in the same shard from one build to the next.
+func partitionSelection(selected selection, n int) []selection {
+	if n == 1 {
+		return []selection{selected}
+	}
+	parts := make([]selection, n)
+	for _, file := range selected.files {
+		k := shardOf(file.name, n)
+		parts[k].files = append(parts[k].files, file)
+	}
+	for _, repo := range selected.gitRepos {
+		k := shardOf(repo.name, n)
+		parts[k].gitRepos = append(parts[k].gitRepos, repo)
+	}
+	return parts
+}
+
+// newBuildID makes the id the metadata files of a build's shards share, so
+// prune can tell which shards go together
+func newBuildID() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func shardOf(name string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(n))
+}
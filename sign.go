@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A backup is signed with an ed25519 key in a detached signature file next to
+// it, so a copy kept on someone else's server can be checked against the key
+// of the machine that made it.  The signature is Ed25519ph over the SHA-512
+// of the whole file, so it's made without reading the backup into memory.
+// Keys are Bech32 strings like the encryption keys: public keys start with
+// "backupsign1", and key files hold secret keys starting with
+// "BACKUP-SIGN-KEY-1".  The signature file is:
+//
+//	backup signature v1
+//	key: <public key>
+//	<base64 signature>
+const (
+	sigSuffix         = ".sig"
+	sigHeader         = "backup signature v1"
+	verifyKeyPrefix   = "backupsign"
+	signingKeyPrefix  = "BACKUP-SIGN-KEY-"
+	signatureContext  = "backup archive"
+	signatureKeyLabel = "key: "
+)
+
+// signatureOptions are the Ed25519ph options signatures are made with
+var signatureOptions = &ed25519.Options{Hash: crypto.SHA512, Context: signatureContext}
+
+// encodeVerifyKey encodes a public key as "backupsign1..."
+func encodeVerifyKey(key ed25519.PublicKey) string {
+	return bech32Encode(verifyKeyPrefix, key)
+}
+
+// parseVerifyKey decodes a "backupsign1..." public key
+func parseVerifyKey(s string) (ed25519.PublicKey, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if hrp != verifyKeyPrefix || len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected a public key starting with %s1", verifyKeyPrefix)
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// readSigningKey reads the secret key in a key file made by 'backup keygen
+// --sign'.  Blank lines and lines starting with # are ignored.
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hrp, seed, err := bech32Decode(line)
+		if err == nil && (hrp != strings.ToLower(signingKeyPrefix) || len(seed) != ed25519.SeedSize) {
+			err = fmt.Errorf("expected a secret key starting with %s1", signingKeyPrefix)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n+1, err.Error())
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	return nil, fmt.Errorf("%s: no secret key", path)
+}
+
+// hashBackup returns the SHA-512 of the file at path
+func hashBackup(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha512.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// signBackup writes the signature of the backup at path to path.sig
+func signBackup(path string, key ed25519.PrivateKey) error {
+	digest, err := hashBackup(path)
+	if err != nil {
+		return err
+	}
+	sig, err := key.Sign(nil, digest, signatureOptions)
+	if err != nil {
+		return err
+	}
+	contents := fmt.Sprintf("%s\n%s%s\n%s\n", sigHeader, signatureKeyLabel,
+		encodeVerifyKey(key.Public().(ed25519.PublicKey)), base64.StdEncoding.EncodeToString(sig))
+	return os.WriteFile(path+sigSuffix, []byte(contents), 0666)
+}
+
+// readSignature reads a signature file, returning the public key it names
+// and the signature
+func readSignature(path string) (ed25519.PublicKey, []byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() && len(lines) < 3 {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(lines) < 3 || lines[0] != sigHeader || !strings.HasPrefix(lines[1], signatureKeyLabel) {
+		return nil, nil, errors.New("not a backup signature file")
+	}
+	key, err := parseVerifyKey(strings.TrimPrefix(lines[1], signatureKeyLabel))
+	if err != nil {
+		return nil, nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, nil, errors.New("malformed signature")
+	}
+	return key, sig, nil
+}
+
+// verifyBackup checks the backup at path against the signature in sigPath,
+// which must have been made by one of trusted.  It returns the key that
+// made it.
+func verifyBackup(path string, sigPath string, trusted []ed25519.PublicKey) (ed25519.PublicKey, error) {
+	key, sig, err := readSignature(sigPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read signature '%s': %s", sigPath, err.Error())
+	}
+	isTrusted := false
+	for _, t := range trusted {
+		isTrusted = isTrusted || bytes.Equal(t, key)
+	}
+	if !isTrusted {
+		return nil, fmt.Errorf("signed by %s, which isn't one of the given keys", encodeVerifyKey(key))
+	}
+	digest, err := hashBackup(path)
+	if err != nil {
+		return nil, err
+	}
+	err = ed25519.VerifyWithOptions(key, digest, sig, signatureOptions)
+	if err != nil {
+		return nil, errors.New("the signature doesn't match, the backup was changed after it was signed")
+	}
+	return key, nil
+}
+
+func sign(args []string) error {
+	var keyPath string
+	var backupPaths []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup sign [--help] -k KEY_FILE <backup_file>...
+
+Signs each backup file with the ed25519 secret key in KEY_FILE, made by
+'backup keygen --sign', writing the signature to <backup_file>.sig.  Keep the
+public key somewhere the storage server can't change it, and use it with
+'backup verify-sig' to prove a backup is the one this machine made.
+Signature files go wherever prune moves their backup.
+
+Options:
+	-h, --help      this help message
+	-k, --key       the file holding the secret key`)
+			return nil
+
+		case "-k", "--key":
+			keyPath = tryGetArg(args, i+1)
+			if keyPath == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			i++
+		default:
+			backupPaths = append(backupPaths, args[i])
+		}
+	}
+	if keyPath == "" {
+		return exitError{
+			msg:  "Expected a key file to sign with",
+			code: 1,
+		}
+	}
+	if len(backupPaths) == 0 {
+		return exitError{
+			msg:  "Expected a backup file to sign",
+			code: 1,
+		}
+	}
+
+	key, err := readSigningKey(keyPath)
+	if err != nil {
+		return exitError{
+			msg:  fmt.Sprintf("Unable to read the signing key: %s", err.Error()),
+			code: 1,
+		}
+	}
+	for _, backupPath := range backupPaths {
+		err = signBackup(backupPath, key)
+		if err != nil {
+			return fmt.Errorf("Unable to sign '%s': %s", backupPath, err.Error())
+		}
+		fmt.Fprintf(os.Stderr, "Signed '%s'\n", backupPath)
+	}
+	return nil
+}
+
+func verifySig(args []string) error {
+	var trusted []ed25519.PublicKey
+	var backupPaths []string
+	var sigPath string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup verify-sig [--help] -k PUBLIC_KEY... [--signature FILE]
+	                  <backup_file>...
+
+Checks each backup file against its detached signature, <backup_file>.sig,
+made by 'backup sign'.  A backup passes if the signature was made by one of
+the given public keys and nothing in the backup has changed since.  Exits
+with status 3 if any backup fails.
+
+Options:
+	-h, --help      this help message
+	-k, --key       a public key made by 'backup keygen --sign' to accept
+	                signatures from; can be used more than once
+	--signature FILE
+	                read the signature from FILE instead, when checking a
+	                single backup`)
+			return nil
+
+		case "-k", "--key":
+			key, err := parseVerifyKey(tryGetArg(args, i+1))
+			if err != nil {
+				return exitError{
+					msg:  fmt.Sprintf("Bad public key after '%s': %s", args[i], err.Error()),
+					code: 1,
+				}
+			}
+			trusted = append(trusted, key)
+			i++
+		case "--signature":
+			sigPath = tryGetArg(args, i+1)
+			if sigPath == "" {
+				return exitError{
+					msg:  fmt.Sprintf("Expected argument after '%s'", args[i]),
+					code: 1,
+				}
+			}
+			i++
+		default:
+			backupPaths = append(backupPaths, args[i])
+		}
+	}
+	if len(trusted) == 0 {
+		return exitError{
+			msg:  "Expected a public key to verify with",
+			code: 1,
+		}
+	}
+	if len(backupPaths) == 0 {
+		return exitError{
+			msg:  "Expected a backup file to verify",
+			code: 1,
+		}
+	}
+	if sigPath != "" && len(backupPaths) > 1 {
+		return exitError{
+			msg:  "--signature can only be used with a single backup",
+			code: 1,
+		}
+	}
+
+	failed := 0
+	for _, backupPath := range backupPaths {
+		path := sigPath
+		if path == "" {
+			path = backupPath + sigSuffix
+		}
+		key, err := verifyBackup(backupPath, path, trusted)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "'%s': FAILED, %s\n", backupPath, err.Error())
+			failed++
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "'%s': good signature by %s\n", backupPath, encodeVerifyKey(key))
+	}
+	if failed > 0 {
+		return exitError{
+			msg:  fmt.Sprintf("%d of %d backups failed verification", failed, len(backupPaths)),
+			code: 3,
+		}
+	}
+	return nil
+}
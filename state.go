@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ownState is what backup itself writes, which builds leave out: an archive
+// being written would otherwise be archived into itself, half finished, and
+// keeping backups in a directory that's backed up would make every backup
+// contain all the ones before it
+type ownState struct {
+	// files are left out by their absolute path
+	files map[string]bool
+	// dirs are left out with everything in them
+	dirs []string
+	// prefixes leave out files whose absolute path starts with them, for the
+	// temporary files the status file is written through
+	prefixes []string
+	// left counts the paths left out
+	left int
+}
+
+// findOwnState collects the outputs of this build, with their sidecar files,
+// the other backups and the trash in the directories they go to, and the
+// status file.  archivePaths and statusPath must be absolute.
+func findOwnState(archivePaths [][]string, statusPath string, mirror bool) *ownState {
+	state := &ownState{files: map[string]bool{}}
+	outDirs := map[string]bool{}
+	for _, paths := range archivePaths {
+		for _, outPath := range paths {
+			if mirror {
+				state.addDir(outPath)
+				continue
+			}
+			state.addFile(outPath)
+			for _, suffix := range sidecarSuffixes {
+				state.addFile(outPath + suffix)
+			}
+			outDirs[filepath.Dir(outPath)] = true
+		}
+	}
+	for dir := range outDirs {
+		state.addDir(filepath.Join(dir, trashDir))
+		backups, err := findStoredBackups(dir)
+		if err != nil {
+			continue
+		}
+		for _, b := range backups {
+			for _, file := range b.files {
+				state.addFile(file)
+				for _, suffix := range sidecarSuffixes {
+					state.addFile(file + suffix)
+				}
+			}
+		}
+	}
+	if statusPath != "" {
+		state.addFile(statusPath)
+		prefix := filepath.Join(filepath.Dir(statusPath), "."+filepath.Base(statusPath)+".")
+		state.prefixes = append(state.prefixes, prefix)
+		if real, ok := resolveParent(prefix); ok {
+			state.prefixes = append(state.prefixes, real)
+		}
+	}
+	return state
+}
+
+// resolveParent resolves the symlinks in the directories leading to path
+func resolveParent(path string) (string, bool) {
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(parent, filepath.Base(path)), true
+}
+
+// addFile leaves out path, both as given and with its directories' symlinks
+// resolved, since the walk may reach it either way
+func (s *ownState) addFile(path string) {
+	s.files[path] = true
+	if real, ok := resolveParent(path); ok {
+		s.files[real] = true
+	}
+}
+
+// addDir leaves out dir and everything in it
+func (s *ownState) addDir(dir string) {
+	s.dirs = append(s.dirs, dir)
+	if real, err := filepath.EvalSymlinks(dir); err == nil && real != dir {
+		s.dirs = append(s.dirs, real)
+	}
+}
+
+// contains reports whether the absolute path is part of backup's own state,
+// counting it if so.  A nil ownState contains nothing.
+func (s *ownState) contains(path string) bool {
+	if s == nil {
+		return false
+	}
+	found := s.files[path]
+	for _, dir := range s.dirs {
+		found = found || path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+	}
+	for _, prefix := range s.prefixes {
+		found = found || strings.HasPrefix(path, prefix)
+	}
+	if found {
+		s.left++
+	}
+	return found
+}
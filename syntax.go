@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// compilePattern returns the regular expression a rule is matched with, or
+// nil if it's a plain glob that filepath.Match can handle.  Case-insensitive
+// globs are translated into regular expressions since filepath.Match has no
+// way to ignore case.
+func compilePattern(rule buildRule) (*regexp.Regexp, error) {
+	var expr string
+	switch {
+	case rule.regex:
+		expr = rule.glob
+	case rule.nocase:
+		if _, err := filepath.Match(rule.glob, ""); err != nil {
+			return nil, err
+		}
+		expr = globToRegexp(rule.glob)
+	default:
+		_, err := filepath.Match(rule.glob, "")
+		return nil, err
+	}
+	// a pattern has to match the whole path, as globs do
+	expr = "^(?:" + expr + ")$"
+	if rule.nocase {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+// globToRegexp translates a glob that filepath.Match accepts into an
+// equivalent regular expression, without the anchors
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	inClass := false
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+			b.WriteByte(c)
+		case c == '[':
+			inClass = true
+			b.WriteByte(c)
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// findMatches walks root for the paths whose names relative to root match
+// re, which is what filepath.Glob does for plain globs.  Matching directories
+// aren't descended into, since the whole directory is selected.  Globs can't
+// match across more directories than they have separators, so for a glob the
+// walk stops at that depth.  Directories for which prune returns true are
+// left out.  Whatever couldn't be read, including root itself, is returned in
+// problems, and the walk carries on past it.
+func findMatches(root string, re *regexp.Regexp, glob string, prune func(string) bool) (matches []string, problems []error) {
+	depth := -1
+	if glob != "" {
+		depth = strings.Count(glob, "/") + 1
+	}
+	filepath.Walk(root, func(wpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			problems = append(problems, err)
+			return nil
+		}
+		if wpath == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, wpath)
+		if err != nil {
+			return nil
+		}
+		if re.MatchString(filepath.ToSlash(rel)) {
+			matches = append(matches, wpath)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if depth > 0 && strings.Count(rel, "/")+1 >= depth {
+				return filepath.SkipDir
+			}
+			if prune(wpath) {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return matches, problems
+}
+
+// matches reports whether the rule counted by stat matches name
+func (stat *ruleStat) matches(name string) bool {
+	if stat.re != nil {
+		return stat.re.MatchString(name)
+	}
+	matched, _ := filepath.Match(stat.rule.glob, name)
+	return matched
+}
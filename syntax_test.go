@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestFindMatchesReportsWalkErrors(t *testing.T) {
+	re := regexp.MustCompile(`^(?:.*\.txt)$`)
+	never := func(string) bool { return false }
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	matches, problems := findMatches(root, re, "", never)
+	if len(matches) != 1 || len(problems) != 0 {
+		t.Errorf("got %v and problems %v, want a.txt alone", matches, problems)
+	}
+
+	matches, problems = findMatches(filepath.Join(root, "missing"), re, "", never)
+	if len(matches) != 0 || len(problems) != 1 {
+		t.Errorf("walking a missing directory gave %v and problems %v, want one problem", matches, problems)
+	}
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"archive/tar"
+	"errors"
+	"fmt"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -11,51 +15,153 @@ import (
 
 /*
 #cgo CFLAGS: -std=c99
-#define _POSIX_SOURCE
-#include <pwd.h>
+#define _POSIX_C_SOURCE 200809L
+#include <errno.h>
 #include <grp.h>
+#include <pwd.h>
 #include <stdint.h>
 #include <stdlib.h>
+#include <string.h>
 #include <sys/types.h>
+#include <unistd.h>
 
-typedef struct names_t {
-	char* username;
-	char* groupname;
-} names_t;
-
-names_t convertIds(uint32_t uid, uint32_t gid) {
-	names_t names;
-	names.username = NULL;
-	names.groupname = NULL;
-
-	struct passwd pwd;
-	struct passwd *user_result;
-	size_t buf_len = 100;
-	char* ubuf = malloc(buf_len);
-	getpwuid_r((uid_t)uid, &pwd, ubuf, buf_len, &user_result);
-
-	if (user_result == NULL) {
-		free(ubuf);
-	} else {
-		names.username = pwd.pw_name;
-	}
+// entries larger than this are given up on rather than growing the buffer
+#define MAX_ENTRY_BUF (1 << 20)
 
-	struct group grp;
-	struct group *grp_result;
-	char* gbuf = malloc(buf_len);
-	getgrgid_r((gid_t)gid, &grp, gbuf, buf_len, &grp_result);
+// entry_buf_len returns the starting buffer size for lookups of kind, one of
+// _SC_GETPW_R_SIZE_MAX or _SC_GETGR_R_SIZE_MAX, which is only a suggestion
+static size_t entry_buf_len(int kind) {
+	long len = sysconf(kind);
+	if (len <= 0) {
+		return 1024;
+	}
+	return (size_t)len;
+}
 
-	if (grp_result == NULL) {
-		free(gbuf);
-	} else {
-		names.groupname = grp.gr_name;
+// user_name returns a copy of the name of uid for the caller to free, or NULL
+// with *err set to what getpwuid_r returned, 0 if there's no such user
+char* user_name(uint32_t uid, int* err) {
+	for (size_t len = entry_buf_len(_SC_GETPW_R_SIZE_MAX); ; len *= 2) {
+		char* buf = malloc(len);
+		if (buf == NULL) {
+			*err = ENOMEM;
+			return NULL;
+		}
+		struct passwd pwd;
+		struct passwd* result = NULL;
+		*err = getpwuid_r((uid_t)uid, &pwd, buf, len, &result);
+		if (*err == ERANGE && len < MAX_ENTRY_BUF) {
+			free(buf);
+			continue;
+		}
+		char* name = NULL;
+		if (*err == 0 && result != NULL) {
+			name = strdup(pwd.pw_name);
+		}
+		free(buf);
+		return name;
 	}
+}
 
-	return names;
+// group_name is user_name for groups
+char* group_name(uint32_t gid, int* err) {
+	for (size_t len = entry_buf_len(_SC_GETGR_R_SIZE_MAX); ; len *= 2) {
+		char* buf = malloc(len);
+		if (buf == NULL) {
+			*err = ENOMEM;
+			return NULL;
+		}
+		struct group grp;
+		struct group* result = NULL;
+		*err = getgrgid_r((gid_t)gid, &grp, buf, len, &result);
+		if (*err == ERANGE && len < MAX_ENTRY_BUF) {
+			free(buf);
+			continue;
+		}
+		char* name = NULL;
+		if (*err == 0 && result != NULL) {
+			name = strdup(grp.gr_name);
+		}
+		free(buf);
+		return name;
+	}
 }
 */
 import "C"
 
+// idNames caches the user and group names of ids for the rest of the run, so
+// each id costs one lookup however many files it owns, even when the lookups
+// go out to a directory service
+type idNames struct {
+	mu     sync.Mutex
+	users  map[uint32]string
+	groups map[uint32]string
+	// unnamed holds the "uid-N" and "gid-N" names given to ids without one
+	unnamed map[string]bool
+}
+
+// ownerNames is shared by every archive being written
+var ownerNames = &idNames{
+	users:   map[uint32]string{},
+	groups:  map[uint32]string{},
+	unnamed: map[string]bool{},
+}
+
+// lookup returns the names of uid and gid.  Ids that don't exist are named
+// "uid-N" and "gid-N", which restoring treats as unknown names and falls back
+// to the stored ids.  When a lookup fails instead, say because the directory
+// service is down, the name is left empty, so only the id is stored, and isn't
+// remembered, so the next file owned by the id tries again.
+func (n *idNames) lookup(uid, gid uint32) (string, string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	username, userOK := n.users[uid]
+	groupname, groupOK := n.groups[gid]
+
+	if !userOK {
+		var status C.int
+		name := C.user_name(C.uint32_t(uid), &status)
+		username, userOK = n.resolve(name, status, "uid-", uid)
+		if userOK {
+			n.users[uid] = username
+		}
+	}
+	if !groupOK {
+		var status C.int
+		name := C.group_name(C.uint32_t(gid), &status)
+		groupname, groupOK = n.resolve(name, status, "gid-", gid)
+		if groupOK {
+			n.groups[gid] = groupname
+		}
+	}
+	return username, groupname
+}
+
+// resolve turns what user_name or group_name returned for id into its name,
+// freeing name, and reports whether the answer is final.  getpwuid_r and
+// getgrgid_r may report a missing entry as any of ENOENT, ESRCH, EBADF or
+// EPERM as well as by finding nothing.
+func (n *idNames) resolve(name *C.char, status C.int, prefix string, id uint32) (string, bool) {
+	defer C.free(unsafe.Pointer(name))
+	if name != nil {
+		return C.GoString(name), true
+	}
+	switch unix.Errno(status) {
+	case 0, unix.ENOENT, unix.ESRCH, unix.EBADF, unix.EPERM:
+		fallback := prefix + strconv.FormatUint(uint64(id), 10)
+		n.unnamed[fallback] = true
+		return fallback, true
+	}
+	return "", false
+}
+
+// named reports whether name was looked up rather than made up from an id
+func (n *idNames) named(name string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return !n.unnamed[name]
+}
+
 // buildTarHeader runs Lstat on the provided path and returns a tar header with
 // all the information converted over.  Returns nil on error.
 //
@@ -67,12 +173,7 @@ func buildTarHeader(path string) *tar.Header {
 		return nil
 	}
 
-	var names C.names_t = C.convertIds(C.uint32_t(info.Uid), C.uint32_t(info.Gid))
-	defer C.free(unsafe.Pointer(names.username))
-	defer C.free(unsafe.Pointer(names.groupname))
-
-	username := C.GoString(names.username)
-	groupname := C.GoString(names.groupname)
+	username, groupname := ownerNames.lookup(info.Uid, info.Gid)
 
 	linkname, _ := os.Readlink(path)
 
@@ -92,12 +193,18 @@ func buildTarHeader(path string) *tar.Header {
 		tarType = tar.TypeReg
 	}
 
+	// only regular files have their contents stored in the archive
+	var size int64
+	if tarType == tar.TypeReg {
+		size = info.Size
+	}
+
 	return &tar.Header{
 		Name:       path,
 		Mode:       int64(info.Mode),
 		Uid:        int(info.Uid),
 		Gid:        int(info.Gid),
-		Size:       info.Size,
+		Size:       size,
 		Uname:      username,
 		Gname:      groupname,
 		ModTime:    time.Unix(info.Mtim.Unix()),
@@ -107,3 +214,33 @@ func buildTarHeader(path string) *tar.Header {
 		ChangeTime: time.Unix(info.Ctim.Unix()),
 	}
 }
+
+// checkMetadata returns an error if header leaves out any of the metadata of
+// the file at path: owners without a name, whose names were made up or
+// couldn't be looked up, and extended attributes, which backups don't store
+func checkMetadata(path string, header *tar.Header) error {
+	if header.Uname == "" || header.Gname == "" || !ownerNames.named(header.Uname) || !ownerNames.named(header.Gname) {
+		return fmt.Errorf("The owner of '%s' (%d:%d) couldn't be looked up", path, header.Uid, header.Gid)
+	}
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil && !errors.Is(err, unix.ENOTSUP) {
+		return fmt.Errorf("Unable to read the extended attributes of '%s': %s", path, err.Error())
+	}
+	if size > 0 {
+		return fmt.Errorf("'%s' has extended attributes, which backups don't store", path)
+	}
+	return nil
+}
+
+// allocatedSize returns the apparent and allocated sizes of a regular file.
+// The allocated size is what the file's blocks take up on disk, much less than
+// the apparent size for sparse files.
+func allocatedSize(path string) (apparent, allocated int64, ok bool) {
+	var info unix.Stat_t
+	err := unix.Lstat(path, &info)
+	if err != nil || info.Mode&unix.S_IFMT != unix.S_IFREG {
+		return 0, 0, false
+	}
+	// st_blocks is always in 512 byte units
+	return info.Size, info.Blocks * 512, true
+}
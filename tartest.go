@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// tarTest shells out to the system tar to confirm it can list every entry of
+// a backup, proving the archive is recoverable with standard tools alone.
+// Each shard is tested on its own, and tar is given --ignore-zeros so it
+// reads past the end of the first part of a concatenated backup.  Listing
+// without an error isn't enough, since tar stops quietly at the first
+// end-of-archive marker without it, so the names tar lists are compared with
+// the entries backup reads itself.
+func tarTest(args []string) error {
+	var backupPath string
+	for _, arg := range args {
+		switch arg {
+		case "--help", "-h":
+			fmt.Println(`Usage:
+	backup tartest [--help] <backup_file>
+
+Runs the system tar against the given backup file and reports whether it could
+read the whole archive, every entry backup itself finds in it.  Backups
+concatenated from several parts are read past the end of the first, as with
+'tar --ignore-zeros', and a backup built with --shards is tested shard by shard
+when given the output without the .N suffixes.  Encrypted backups always fail,
+since tar can't read them.  Backups built with '--compat tar' are expected to
+pass.  Exits with status 3 if tar can't read all of the backup.`)
+			return nil
+
+		default:
+			if backupPath != "" {
+				return exitError{
+					msg:  "Can only test one backup at a time",
+					code: 1,
+				}
+			}
+			backupPath = arg
+		}
+	}
+	if backupPath == "" {
+		return exitError{
+			msg:  "Expected a backup file to test",
+			code: 1,
+		}
+	}
+
+	tarPath, err := exec.LookPath("tar")
+	if err != nil {
+		return fmt.Errorf("Unable to find a system tar: %s", err.Error())
+	}
+	paths, err := backupFiles(backupPath)
+	if err != nil {
+		return fmt.Errorf("Unable to open '%s': %s", backupPath, err.Error())
+	}
+	for _, path := range paths {
+		err = tarTestFile(tarPath, path)
+		if err != nil {
+			return exitError{
+				msg:  fmt.Sprintf("System tar (%s) failed to read '%s': %s", tarPath, path, err.Error()),
+				code: 3,
+			}
+		}
+	}
+	fmt.Printf("System tar (%s) read '%s' successfully\n", tarPath, backupPath)
+	return nil
+}
+
+// tarTestFile checks that the system tar lists as many entries in the file
+// at path as backup finds
+func tarTestFile(tarPath, path string) error {
+	encrypted, err := isEncryptedFile(path)
+	if err != nil {
+		return err
+	} else if encrypted {
+		return fmt.Errorf("it's encrypted")
+	}
+
+	// GNU tar and bsdtar both escape newlines and other unprintable
+	// characters in names, so each name is on a line of its own.  bsdtar
+	// refuses UTF-8 names it can't convert to the locale's encoding.
+	cmd := exec.Command(tarPath, "--ignore-zeros", "-tzf", path)
+	cmd.Env = append(os.Environ(), "LC_ALL=C.UTF-8")
+	cmd.Stderr = os.Stderr
+	listing, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	var listed []string
+	if len(listing) > 0 {
+		listed = strings.Split(strings.TrimSuffix(string(listing), "\n"), "\n")
+	}
+
+	backup, err := openBackup(path)
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+	var names []string
+	err = backup.eachEntry(func(header *tar.Header) error {
+		names = append(names, header.Name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		if i >= len(listed) {
+			return fmt.Errorf("it listed %d of the %d entries, stopping before '%s'", len(listed), len(names), name)
+		}
+		if normalizeTarName(unescapeTarName(listed[i])) != normalizeTarName(name) {
+			return fmt.Errorf("it listed '%s' where backup found '%s'", listed[i], name)
+		}
+	}
+	if len(listed) > len(names) {
+		return fmt.Errorf("it listed %d entries, but backup found %d", len(listed), len(names))
+	}
+	return nil
+}
+
+// tarEscapes are the C escapes tar lists unprintable characters in names as
+var tarEscapes = map[byte]byte{
+	'\\': '\\', 'a': '\a', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t', 'v': '\v',
+}
+
+// unescapeTarName undoes the escaping of a name listed by tar: C escapes and
+// three digit octal ones.  Anything else is left as it is.
+func unescapeTarName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if c, ok := tarEscapes[s[i+1]]; ok {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		if i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// normalizeTarName drops what tar may add to or take from a name when
+// listing it: a leading / and a directory's trailing /
+func normalizeTarName(name string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(name, "/"), "/")
+}
+
+// isEncryptedFile reports whether the file at path is encrypted by backup or
+// by gpg
+func isEncryptedFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	raw := bufio.NewReader(file)
+	return isEncrypted(raw) || isGPGMessage(raw), nil
+}
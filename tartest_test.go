@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarTestReadsEveryPartAndShard(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("no system tar")
+	}
+	tmp := t.TempDir()
+	var parts []string
+	for k := 0; k < 2; k++ {
+		part := filepath.Join(tmp, fmt.Sprintf("part%d.tgz", k))
+		name := fmt.Sprintf("file%d", k)
+		writeTestBackup(t, part, []*tar.Header{
+			{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Format: tar.FormatPAX},
+		}, map[string]string{name: name})
+		parts = append(parts, part)
+	}
+
+	// two parts concatenated, where tar stops after the first without
+	// --ignore-zeros
+	var whole []byte
+	for _, part := range parts {
+		data, err := os.ReadFile(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whole = append(whole, data...)
+	}
+	concatenated := filepath.Join(tmp, "whole.tgz")
+	if err := os.WriteFile(concatenated, whole, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tarTest([]string{concatenated}); err != nil {
+		t.Errorf("concatenated backup: %s", err)
+	}
+
+	// the same parts as the shards of one build
+	base := filepath.Join(tmp, "sharded.tgz")
+	for k, part := range parts {
+		if err := os.Rename(part, fmt.Sprintf("%s.%d", base, k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarTest([]string{base}); err != nil {
+		t.Errorf("sharded backup: %s", err)
+	}
+}
+
+func TestTarTestFailsEncryptedBackups(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("no system tar")
+	}
+	path := filepath.Join(t.TempDir(), "encrypted.tgz")
+	if err := os.WriteFile(path, []byte(encryptedMagic+"rest of the header"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tarTest([]string{path}); err == nil {
+		t.Error("passed an encrypted backup")
+	}
+}
+
+func TestTarTestComparesNames(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("no system tar")
+	}
+	path := filepath.Join(t.TempDir(), "names.tgz")
+	var headers []*tar.Header
+	for _, name := range []string{"line\nbreak", "back\\slash", "tab\there", "café", "dir/"} {
+		typeflag := byte(tar.TypeReg)
+		if name == "dir/" {
+			typeflag = tar.TypeDir
+		}
+		headers = append(headers, &tar.Header{Name: name, Typeflag: typeflag, Mode: 0644, Format: tar.FormatPAX})
+	}
+	writeTestBackup(t, path, headers, nil)
+	if err := tarTest([]string{path}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// seekLatency is the average latency above which the disk is taken to be
+// busy seeking.  Solid state disks stay well below it, spinning disks don't.
+const seekLatency = 5 * time.Millisecond
+
+// throttle paces reads from a slow disk.  It keeps a running average of how
+// long reads take, and while that's high it pauses for as long again after
+// each one, leaving the disk idle about half the time for everything else.  A
+// nil throttle never pauses.
+type throttle struct {
+	mu      sync.Mutex
+	average time.Duration
+}
+
+// observe records how long a read took, then pauses if the disk is busy
+func (t *throttle) observe(took time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.average = (7*t.average + took) / 8
+	pause := t.average
+	t.mu.Unlock()
+	if pause > seekLatency {
+		time.Sleep(pause)
+	}
+}
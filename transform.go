@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// nameTransform rewrites the names of entries as they're restored
+type nameTransform struct {
+	// re and replacement make up a sed-style substitution
+	re          *regexp.Regexp
+	replacement string
+	global      bool
+	// from and to make up a prefix mapping, used when re is nil
+	from, to string
+}
+
+// parseTransform parses either a sed-style substitution, 's|OLD|NEW|' with
+// an optional g flag and any punctuation as the delimiter, or a prefix
+// mapping, 'OLD=NEW'
+func parseTransform(s string) (nameTransform, error) {
+	if len(s) > 1 && s[0] == 's' && strings.ContainsRune("|/#,:;!@%", rune(s[1])) {
+		parts := strings.Split(s[2:], s[1:2])
+		if len(parts) != 3 {
+			return nameTransform{}, fmt.Errorf("expected s%cOLD%cNEW%c", s[1], s[1], s[1])
+		}
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			return nameTransform{}, err
+		}
+		var global bool
+		switch parts[2] {
+		case "":
+		case "g":
+			global = true
+		default:
+			return nameTransform{}, fmt.Errorf("unknown flags '%s'", parts[2])
+		}
+		// a $ in NEW is literal, as in sed, and sed's \1 is ${1} to regexp
+		replacement := strings.ReplaceAll(parts[1], "$", "$$")
+		replacement = regexp.MustCompile(`\\(\d)`).ReplaceAllString(replacement, "$${$1}")
+		return nameTransform{re: re, replacement: replacement, global: global}, nil
+	}
+
+	from, to, found := strings.Cut(s, "=")
+	if !found || from == "" {
+		return nameTransform{}, fmt.Errorf("expected s|OLD|NEW| or OLD=NEW")
+	}
+	return nameTransform{
+		from: strings.TrimSuffix(from, "/"),
+		to:   strings.TrimSuffix(to, "/"),
+	}, nil
+}
+
+// apply returns name as rewritten by the transform
+func (t nameTransform) apply(name string) string {
+	if t.re == nil {
+		// a prefix only matches whole path elements
+		switch {
+		case name == t.from:
+			return t.to
+		case strings.HasPrefix(name, t.from+"/"):
+			if t.to == "" {
+				return name[len(t.from)+1:]
+			}
+			return t.to + name[len(t.from):]
+		}
+		return name
+	}
+	if t.global {
+		return t.re.ReplaceAllString(name, t.replacement)
+	}
+	match := t.re.FindStringSubmatchIndex(name)
+	if match == nil {
+		return name
+	}
+	expanded := t.re.ExpandString(nil, t.replacement, name, match)
+	return name[:match[0]] + string(expanded) + name[match[1]:]
+}
+
+// transformName applies every transform to name in order
+func transformName(transforms []nameTransform, name string) string {
+	for _, t := range transforms {
+		name = t.apply(name)
+	}
+	return name
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestTransformReplacement(t *testing.T) {
+	tests := []struct {
+		rule, name, want string
+	}{
+		{`s|^old/|new/|`, "old/file", "new/file"},
+		{`s|(a+)(b+)|\2\1|`, "aabb.txt", "bbaa.txt"},
+		{`s|a|x|g`, "banana", "bxnxnx"},
+		// $ is literal, not a regexp group reference
+		{`s|^price|$1|`, "price.txt", "$1.txt"},
+		{`s|^(p)rice|$USD\1|g`, "price.txt", "$USDp.txt"},
+		{`s|x|${name}|`, "x", "${name}"},
+		{`old=new`, "old/file", "new/file"},
+	}
+	for _, test := range tests {
+		transform, err := parseTransform(test.rule)
+		if err != nil {
+			t.Errorf("%s: %s", test.rule, err)
+			continue
+		}
+		if got := transform.apply(test.name); got != test.want {
+			t.Errorf("%s applied to %q is %q, want %q", test.rule, test.name, got, test.want)
+		}
+	}
+}